@@ -0,0 +1,60 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/helper/salt"
+	"github.com/hashicorp/vault/logical"
+)
+
+// apiKeyVisibleChars is the number of trailing characters of the API key that
+// are shown in the fingerprint, like in the Mailgun dashboard.
+const apiKeyVisibleChars = 4
+
+// Salt returns the salt of this mount, creating it on first use.
+func (b *mailgunBackend) Salt(ctx context.Context, s logical.Storage) (*salt.Salt, error) {
+	b.saltMutex.RLock()
+	if b.salt != nil {
+		defer b.saltMutex.RUnlock()
+		return b.salt, nil
+	}
+	b.saltMutex.RUnlock()
+
+	b.saltMutex.Lock()
+	defer b.saltMutex.Unlock()
+	if b.salt != nil {
+		return b.salt, nil
+	}
+	newSalt, err := salt.NewSalt(ctx, s, &salt.Config{
+		HashFunc: salt.SHA256Hash,
+		Location: salt.DefaultLocation,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.salt = newSalt
+	return newSalt, nil
+}
+
+// apiKeyFingerprint returns a non-reversible fingerprint of the API key. It
+// consists of the last characters of the key and a salted HMAC of it.
+func (b *mailgunBackend) apiKeyFingerprint(ctx context.Context, s logical.Storage, apiKey string) (string, error) {
+	keySalt, err := b.Salt(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	suffix := ""
+	// Short keys would be mostly revealed by their last characters.
+	if len(apiKey) > 2*apiKeyVisibleChars {
+		suffix = apiKey[len(apiKey)-apiKeyVisibleChars:] + ":"
+	}
+	return suffix + keySalt.GetIdentifiedHMAC(apiKey), nil
+}
+
+func (b *mailgunBackend) invalidate(ctx context.Context, key string) {
+	switch key {
+	case salt.DefaultLocation:
+		b.saltMutex.Lock()
+		b.salt = nil
+		b.saltMutex.Unlock()
+	}
+}
@@ -2,9 +2,14 @@ package mgsecret
 
 import (
 	"context"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/helper/salt"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"strings"
+	"sync"
+	"time"
 )
 
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
@@ -18,32 +23,148 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 type mailgunBackend struct {
 	*framework.Backend
 	MailgunFactory func(domain, apiKey string) MailgunClient
+	SmtpVerifier   SmtpVerifier
+
+	metrics   metricsEmitter
+	telemetry *telemetrySink
+
+	smtpVerifyInterval time.Duration
+
+	salt      *salt.Salt
+	saltMutex sync.RWMutex
+
+	// libraryLock serializes all changes to the library pools.
+	libraryLock sync.Mutex
+
+	activityCache map[string]*activityCacheEntry
+	activityLock  sync.Mutex
+
+	credentialsCache *credentialsCache
+	credentialsLock  sync.Mutex
+
+	// inventoryLocks serialize the updates of an inventory entry by the
+	// webhook, the monitor and the revocations. Entries of library logins
+	// are serialized by libraryLock instead.
+	inventoryLocks []*locksutil.LockEntry
+
+	// webhookLock serializes the check and the record of webhook tokens.
+	webhookLock sync.Mutex
+
+	health *apiHealth
 }
 
 func backend() *mailgunBackend {
 	var b mailgunBackend
 	b.MailgunFactory = DefaultMailgunClientFactory
+	b.SmtpVerifier = DefaultSmtpVerifier
+	b.telemetry = &telemetrySink{}
+	b.metrics = b.telemetry
+	b.activityCache = map[string]*activityCacheEntry{}
+	b.inventoryLocks = locksutil.CreateLocks()
+	b.health = newApiHealth()
+	b.smtpVerifyInterval = time.Second
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
 		PathsSpecial: &logical.Paths{
+			Unauthenticated: []string{
+				"webhook",
+			},
 			SealWrapStorage: []string{
 				"config",
+				configHistoryStoragePrefix,
 			},
 		},
 		Paths: framework.PathAppend(
 			[]*framework.Path{
 				pathConfig(&b),
+				pathConfigHistoryList(&b),
+				pathConfigHistory(&b),
+				pathConfigRollback(&b),
+				pathConfigPromote(&b),
+				pathListRoles(&b),
+				pathRoles(&b),
 				pathCredentials(&b),
+				pathRoleCredentials(&b),
+				pathLibraryCheckOut(&b),
+				pathLibraryCheckIn(&b),
+				pathLibraryStatus(&b),
+				pathInventoryList(&b),
+				pathInventory(&b),
+				pathLookup(&b),
+				pathLookupDisable(&b),
+				pathReconcile(&b),
+				pathActivity(&b),
+				pathWebhook(&b),
+				pathHealth(&b),
+				pathSuppressionList(&b),
+				pathSuppression(&b),
 			},
 		),
 		Secrets: []*framework.Secret{
 			secretCredentials(&b),
+			secretMailingList(&b),
+			secretLibraryCredential(&b),
 		},
-		BackendType: logical.TypeLogical,
+		PeriodicFunc: b.periodicFunc,
+		Invalidate:   b.invalidate,
+		BackendType:  logical.TypeLogical,
 	}
 	return &b
 }
 
+// HandleRequest logs the request if verbose logging is enabled in the config.
+// The telemetry is configured from the config before each request, so changes
+// of other nodes and the periodic function pick it up as well.
+func (b *mailgunBackend) HandleRequest(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	if req.Storage == nil {
+		return b.Backend.HandleRequest(ctx, req)
+	}
+	// Errors reading the config are returned by the handlers.
+	cfg, err := getConfig(ctx, req.Storage)
+	if err == nil {
+		b.configureTelemetry(cfg)
+	}
+	if err != nil || cfg == nil || !cfg.VerboseLogging {
+		return b.Backend.HandleRequest(ctx, req)
+	}
+
+	start := time.Now()
+	resp, err := b.Backend.HandleRequest(ctx, req)
+	args := []interface{}{
+		"operation", req.Operation,
+		"path", req.Path,
+		"request_id", req.ID,
+		"duration", time.Since(start),
+	}
+	switch {
+	case err != nil:
+		args = append(args, "error", err)
+	case resp.IsError():
+		args = append(args, "error", resp.Error())
+	}
+	b.Logger().Info("handled request", args...)
+	return resp, err
+}
+
+// periodicFunc runs the background jobs. A failing job does not keep the
+// others from running, their errors are combined.
+func (b *mailgunBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	var result *multierror.Error
+	jobs := []func(context.Context, logical.Storage) error{
+		b.refillLibraries,
+		b.monitorCredentials,
+		b.pruneInventory,
+		b.pruneWebhookTokens,
+		b.emitActiveCredentials,
+	}
+	for _, job := range jobs {
+		if err := job(ctx, req.Storage); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
 const backendHelp = `
 The Mailgun secrets backend dynamically generates Mailgun SMTP credentials 
 for a given domain.The service account keys have a configurable lease set and 
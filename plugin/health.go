@@ -0,0 +1,367 @@
+package mgsecret
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// circuitFailureThreshold is the number of consecutive failed Mailgun
+	// API calls that opens the circuit.
+	circuitFailureThreshold = 5
+	// circuitOpenDuration is how long calls fail without asking the Mailgun
+	// API before it is tried again.
+	circuitOpenDuration = 30 * time.Second
+	// healthWindow is the time the error rate is calculated for.
+	healthWindow = 5 * time.Minute
+	// healthProbeInterval is how long a successful call makes probing the
+	// Mailgun API unnecessary.
+	healthProbeInterval = time.Minute
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+var errCircuitOpen = errors.New("mailgun api calls are suspended after repeated failures")
+
+func pathHealth(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "health",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathHealthRead,
+				Summary:  "Report whether the plugin is configured and the Mailgun API is reachable.",
+				Responses: map[int][]framework.Response{
+					http.StatusOK: {{
+						Description: "Mailgun is reachable.",
+						Example: &logical.Response{Data: map[string]interface{}{
+							"configured":      true,
+							"domain":          "example.com",
+							"reachable":       true,
+							"last_success_at": "2019-01-02T15:04:05Z",
+							"last_error":      "",
+							"last_error_at":   "",
+							"requests":        12,
+							"errors":          0,
+							"error_rate":      0.0,
+							"error_window":    int(healthWindow / time.Second),
+							"circuit_state":   circuitClosed,
+						}},
+					}},
+					http.StatusNotImplemented: {{
+						Description: "The plugin is not configured.",
+						Example: &logical.Response{Data: map[string]interface{}{
+							"configured": false,
+						}},
+					}},
+					http.StatusServiceUnavailable: {{
+						Description: "Mailgun is not reachable or the circuit is open. The data is the same as for 200.",
+					}},
+					http.StatusInternalServerError: {errorResponses[http.StatusInternalServerError]},
+				},
+			},
+		},
+		HelpSynopsis:    pathHealthHelpSyn,
+		HelpDescription: pathHealthHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathHealthRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.RespondWithStatusCode(&logical.Response{
+			Data: map[string]interface{}{
+				"configured": false,
+			},
+		}, req, http.StatusNotImplemented)
+	}
+
+	// The API is only probed if it was not used successfully recently.
+	status := b.health.status()
+	reachable := status.circuitState != circuitOpen && time.Since(status.lastSuccess) < healthProbeInterval
+	if status.circuitState != circuitOpen && !reachable {
+		reachable = b.client(config).IsApiKeyValid()
+		status = b.health.status()
+	}
+
+	respData := map[string]interface{}{
+		"configured":      true,
+		"domain":          config.Domain,
+		"reachable":       reachable,
+		"last_success_at": formatTime(status.lastSuccess),
+		"last_error":      status.lastError,
+		"last_error_at":   formatTime(status.lastErrorAt),
+		"requests":        status.requests,
+		"errors":          status.errors,
+		"error_rate":      status.errorRate(),
+		"error_window":    int64(healthWindow / time.Second),
+		"circuit_state":   status.circuitState,
+	}
+	code := http.StatusOK
+	if !reachable {
+		code = http.StatusServiceUnavailable
+	}
+	return logical.RespondWithStatusCode(&logical.Response{Data: respData}, req, code)
+}
+
+// apiHealth tracks the outcome of the Mailgun API calls and opens the circuit
+// after repeated failures that indicate an outage.
+type apiHealth struct {
+	sync.Mutex
+
+	calls               []apiCall
+	lastSuccess         time.Time
+	lastError           string
+	lastErrorAt         time.Time
+	consecutiveFailures int
+	openedAt            time.Time
+}
+
+type apiCall struct {
+	at     time.Time
+	failed bool
+}
+
+type apiHealthStatus struct {
+	requests, errors int
+	lastSuccess      time.Time
+	lastError        string
+	lastErrorAt      time.Time
+	circuitState     string
+}
+
+func (s apiHealthStatus) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.errors) / float64(s.requests)
+}
+
+func newApiHealth() *apiHealth {
+	return &apiHealth{}
+}
+
+func (h *apiHealth) circuitState() string {
+	switch {
+	case h.consecutiveFailures < circuitFailureThreshold:
+		return circuitClosed
+	case time.Since(h.openedAt) < circuitOpenDuration:
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+// allow returns errCircuitOpen if calls are suspended.
+func (h *apiHealth) allow() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.circuitState() == circuitOpen {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+// record records the outcome of a call. Only errors of the classes that
+// indicate an outage count as failed calls and towards opening the circuit,
+// expected errors like a missing resource do not.
+func (h *apiHealth) record(err error) {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	h.prune(now)
+	failed := isOutageError(err)
+	h.calls = append(h.calls, apiCall{at: now, failed: failed})
+	if !failed {
+		if err == nil {
+			h.lastSuccess = now
+		}
+		// The API answered, so it is reachable.
+		h.consecutiveFailures = 0
+		return
+	}
+
+	h.lastError = err.Error()
+	h.lastErrorAt = now
+	h.consecutiveFailures++
+	if h.consecutiveFailures >= circuitFailureThreshold {
+		h.openedAt = now
+	}
+}
+
+// isOutageError returns true if err indicates that the Mailgun API is not
+// available.
+func isOutageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errApiKeyRejected || err == errDomainRejected {
+		// The client does not tell a rejection from an unreachable API.
+		return true
+	}
+	switch classifyError(err) {
+	case errorClassServerError, errorClassNetwork, errorClassTimeout, errorClassRateLimited:
+		return true
+	}
+	return false
+}
+
+func (h *apiHealth) prune(now time.Time) {
+	keep := 0
+	for keep < len(h.calls) && now.Sub(h.calls[keep].at) > healthWindow {
+		keep++
+	}
+	h.calls = h.calls[keep:]
+}
+
+func (h *apiHealth) status() apiHealthStatus {
+	h.Lock()
+	defer h.Unlock()
+	h.prune(time.Now())
+	status := apiHealthStatus{
+		requests:     len(h.calls),
+		lastSuccess:  h.lastSuccess,
+		lastError:    h.lastError,
+		lastErrorAt:  h.lastErrorAt,
+		circuitState: h.circuitState(),
+	}
+	for _, call := range h.calls {
+		if call.failed {
+			status.errors++
+		}
+	}
+	return status
+}
+
+// healthTrackingClient records the outcome of every call in the health of
+// the backend and fails without calling Mailgun while the circuit is open.
+type healthTrackingClient struct {
+	client MailgunClient
+	health *apiHealth
+}
+
+var errApiKeyRejected = errors.New("api key rejected by mailgun")
+var errDomainRejected = errors.New("domain rejected by mailgun")
+
+func (c healthTrackingClient) call(f func() error) error {
+	if err := c.health.allow(); err != nil {
+		return err
+	}
+	err := f()
+	c.health.record(err)
+	return err
+}
+
+func (c healthTrackingClient) IsDomainValid() bool {
+	return c.call(func() error {
+		if !c.client.IsDomainValid() {
+			return errDomainRejected
+		}
+		return nil
+	}) == nil
+}
+
+func (c healthTrackingClient) IsApiKeyValid() bool {
+	return c.call(func() error {
+		if !c.client.IsApiKeyValid() {
+			return errApiKeyRejected
+		}
+		return nil
+	}) == nil
+}
+
+func (c healthTrackingClient) DeleteCredential(username string) error {
+	return c.call(func() error {
+		return c.client.DeleteCredential(username)
+	})
+}
+
+func (c healthTrackingClient) CreateCredential(login, password string) error {
+	return c.call(func() error {
+		return c.client.CreateCredential(login, password)
+	})
+}
+
+func (c healthTrackingClient) ChangeCredentialPassword(login, password string) error {
+	return c.call(func() error {
+		return c.client.ChangeCredentialPassword(login, password)
+	})
+}
+
+func (c healthTrackingClient) ListAllCredentials() ([]mailgun.Credential, error) {
+	var credentials []mailgun.Credential
+	err := c.call(func() (err error) {
+		credentials, err = c.client.ListAllCredentials()
+		return err
+	})
+	return credentials, err
+}
+
+func (c healthTrackingClient) CreateList(prototype mailgun.List) (mailgun.List, error) {
+	var list mailgun.List
+	err := c.call(func() (err error) {
+		list, err = c.client.CreateList(prototype)
+		return err
+	})
+	return list, err
+}
+
+func (c healthTrackingClient) CreateMemberList(subscribed *bool, address string, newMembers []interface{}) error {
+	return c.call(func() error {
+		return c.client.CreateMemberList(subscribed, address, newMembers)
+	})
+}
+
+func (c healthTrackingClient) DeleteList(address string) error {
+	return c.call(func() error {
+		return c.client.DeleteList(address)
+	})
+}
+
+func (c healthTrackingClient) GetListByAddress(address string) (mailgun.List, error) {
+	var list mailgun.List
+	err := c.call(func() (err error) {
+		list, err = c.client.GetListByAddress(address)
+		return err
+	})
+	return list, err
+}
+
+func (c healthTrackingClient) ListSenderEvents(sender string, since time.Time, limit int) ([]mailgun.Event, error) {
+	var events []mailgun.Event
+	err := c.call(func() (err error) {
+		events, err = c.client.ListSenderEvents(sender, since, limit)
+		return err
+	})
+	return events, err
+}
+
+const pathHealthHelpSyn = `
+Report the health of the plugin and the Mailgun API.
+`
+
+const pathHealthHelpDesc = `
+Reading "health" reports whether the plugin is configured, whether the
+Mailgun API is reachable, the time of the last successful call, the error
+rate of the calls within the last five minutes and the state of the circuit.
+
+The Mailgun API is only asked if no call succeeded within the last minute.
+After five consecutive server errors, network errors, timeouts or rate
+limited calls the circuit opens: calls fail without asking Mailgun for 30
+seconds, then the next call is tried ("half_open").
+
+The HTTP status is 200 if Mailgun is reachable, 503 if it is not and 501 if
+the plugin is not configured.
+`
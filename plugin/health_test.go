@@ -0,0 +1,178 @@
+package mgsecret
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPathHealth(t *testing.T) {
+	t.Run("unconfigured mount", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		code, data := requestHealth(t, b, storage)
+
+		if code != http.StatusNotImplemented {
+			t.Error("status should be", http.StatusNotImplemented, "but is", code)
+		}
+		if data["configured"] != false {
+			t.Error("configured should be false but is", data["configured"])
+		}
+	})
+
+	t.Run("reachable mailgun", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		code, data := requestHealth(t, b, storage)
+
+		if code != http.StatusOK {
+			t.Error("status should be", http.StatusOK, "but is", code)
+		}
+		if data["reachable"] != true || data["circuit_state"] != circuitClosed {
+			t.Error("Unexpected health:", data)
+		}
+		if data["last_success_at"] == "" {
+			t.Error("last_success_at should be set")
+		}
+	})
+
+	t.Run("unreachable mailgun", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		b.MailgunFactory = generateMailgunClientFactory(true, false)
+
+		code, data := requestHealth(t, b, storage)
+
+		if code != http.StatusServiceUnavailable {
+			t.Error("status should be", http.StatusServiceUnavailable, "but is", code)
+		}
+		if data["reachable"] != false || data["errors"] != 1.0 || data["error_rate"] != 1.0 {
+			t.Error("Unexpected health:", data)
+		}
+	})
+
+	t.Run("open circuit is reported without probing", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		for i := 0; i < circuitFailureThreshold; i++ {
+			b.health.record(&mailgun.UnexpectedResponseError{Actual: http.StatusBadGateway})
+		}
+
+		code, data := requestHealth(t, b, storage)
+
+		if code != http.StatusServiceUnavailable {
+			t.Error("status should be", http.StatusServiceUnavailable, "but is", code)
+		}
+		if data["circuit_state"] != circuitOpen || data["requests"] != float64(circuitFailureThreshold) {
+			t.Error("Unexpected health:", data)
+		}
+	})
+}
+
+func TestApiHealth(t *testing.T) {
+	t.Run("server errors open the circuit", func(t *testing.T) {
+		t.Parallel()
+		h := newApiHealth()
+		for i := 0; i < circuitFailureThreshold; i++ {
+			if err := h.allow(); err != nil {
+				t.Fatal("call", i, "should be allowed but got", err)
+			}
+			h.record(&mailgun.UnexpectedResponseError{Actual: http.StatusInternalServerError})
+		}
+
+		if err := h.allow(); err != errCircuitOpen {
+			t.Error("calls should fail with open circuit but got", err)
+		}
+	})
+
+	t.Run("client errors keep the circuit closed", func(t *testing.T) {
+		t.Parallel()
+		h := newApiHealth()
+		for i := 0; i < 2*circuitFailureThreshold; i++ {
+			h.record(&mailgun.UnexpectedResponseError{Actual: http.StatusNotFound})
+		}
+
+		if status := h.status(); status.circuitState != circuitClosed || status.errors != 0 || status.lastError != "" {
+			t.Error("client errors should not count as failed calls:", status)
+		}
+	})
+
+	t.Run("success after open duration closes the circuit", func(t *testing.T) {
+		t.Parallel()
+		h := newApiHealth()
+		for i := 0; i < circuitFailureThreshold; i++ {
+			h.record(&mailgun.UnexpectedResponseError{Actual: http.StatusServiceUnavailable})
+		}
+		h.openedAt = h.openedAt.Add(-circuitOpenDuration)
+
+		if state := h.status().circuitState; state != circuitHalfOpen {
+			t.Fatal("circuit should be half open but is", state)
+		}
+		if err := h.allow(); err != nil {
+			t.Fatal("call should be allowed but got", err)
+		}
+		h.record(nil)
+
+		if state := h.status().circuitState; state != circuitClosed {
+			t.Error("circuit should be closed but is", state)
+		}
+	})
+
+	t.Run("open circuit fails calls of the client", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		for i := 0; i < circuitFailureThreshold; i++ {
+			b.health.record(&mailgun.UnexpectedResponseError{Actual: http.StatusBadGateway})
+		}
+
+		resp := requestCredentials(t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("credentials should not be created with open circuit")
+		}
+		if len(testClient(b).credentials) != 0 {
+			t.Error("mailgun should not be called with open circuit")
+		}
+	})
+
+	t.Run("calls outside the window are not counted", func(t *testing.T) {
+		t.Parallel()
+		h := newApiHealth()
+		h.record(&mailgun.UnexpectedResponseError{Actual: http.StatusInternalServerError})
+		h.calls[0].at = time.Now().Add(-2 * healthWindow)
+		h.record(nil)
+
+		if status := h.status(); status.requests != 1 || status.errors != 0 {
+			t.Error("Unexpected status:", status)
+		}
+	})
+}
+
+// requestHealth returns the HTTP status and the data of the health response.
+func requestHealth(t *testing.T, b *mailgunBackend, storage logical.Storage) (int, map[string]interface{}) {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "health",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Data[logical.HTTPStatusCode].(int), body.Data
+}
@@ -0,0 +1,341 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	inventoryStoragePrefix    = "inventory/"
+	defaultInventoryRetention = 30 * 24 * time.Hour
+)
+
+// Reasons for the revocation of a credential recorded in the inventory.
+const (
+	revokedReasonLease         = "lease revoked"
+	revokedReasonConfigDeleted = "config deleted with revoke_outstanding"
+	revokedReasonLookupDisable = "disabled with lookup"
+	revokedReasonCheckIn       = "checked in"
+)
+
+func pathInventoryList(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "creds-inventory/?$",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathInventoryList,
+				Summary:  "List the credentials issued by this mount.",
+				Responses: operationResponses(http.StatusOK, "The issued credentials with their type, role, creation time and whether they are revoked.", logical.ListResponseWithInfo([]string{"vault.k3x9a"}, map[string]interface{}{
+					"vault.k3x9a": map[string]interface{}{
+						"credential_type": credentialTypeSmtp,
+						"role":            "ci",
+						"created_at":      "2019-01-02T15:04:05Z",
+						"revoked":         false,
+					},
+				}).Data),
+			},
+		},
+		HelpSynopsis:    pathInventoryHelpSyn,
+		HelpDescription: pathInventoryHelpDesc,
+	}
+}
+
+func pathInventory(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "creds-inventory/(?P<username>.+)",
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "SMTP login or mailing list address of the credential.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathInventoryRead,
+				Summary:  "Return an issued credential.",
+				Responses: operationResponses(http.StatusOK, "The issued credential.", map[string]interface{}{
+					"username":        "vault.k3x9a",
+					"credential_type": credentialTypeSmtp,
+					"domain":          "example.com",
+					"role":            "ci",
+					"lease_prefix":    "mailgun/credentials/ci",
+					"entity_id":       "...",
+					"display_name":    "token-ci",
+					"created_at":      "2019-01-02T15:04:05Z",
+					"last_used_at":    "2019-01-02T16:04:05Z",
+					"last_checked_at": "2019-01-02T16:05:00Z",
+					"idle_at":         "",
+					"revoked":         true,
+					"revoked_at":      "2019-01-02T17:04:05Z",
+					"revoked_reason":  revokedReasonLease,
+				}, http.StatusNotFound),
+			},
+		},
+		HelpSynopsis:    pathInventoryHelpSyn,
+		HelpDescription: pathInventoryHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathInventoryList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entries, err := listInventory(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	keyInfo := make(map[string]interface{}, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Username)
+		keyInfo[entry.Username] = map[string]interface{}{
+			"credential_type": entry.CredentialType,
+			"role":            entry.Role,
+			"created_at":      formatTime(entry.CreatedAt),
+			"revoked":         entry.revoked(),
+		}
+	}
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *mailgunBackend) pathInventoryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entry, err := getInventoryEntry(ctx, req.Storage, data.Get("username").(string))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"username":        entry.Username,
+			"credential_type": entry.CredentialType,
+			"domain":          entry.Domain,
+			"role":            entry.Role,
+			"lease_prefix":    entry.LeasePrefix,
+			"entity_id":       entry.EntityID,
+			"display_name":    entry.DisplayName,
+			"created_at":      formatTime(entry.CreatedAt),
+			"last_used_at":    formatTime(entry.LastUsedAt),
+			"last_checked_at": formatTime(entry.LastCheckedAt),
+			"idle_at":         formatTime(entry.IdleAt),
+			"revoked":         entry.revoked(),
+			"revoked_at":      formatTime(entry.RevokedAt),
+			"revoked_reason":  entry.RevokedReason,
+		},
+	}, nil
+}
+
+// inventoryEntry records a credential issued by this mount, so it can be
+// looked up and cleaned up without the lease. Username is the SMTP login or
+// the address of the mailing list.
+type inventoryEntry struct {
+	Username       string
+	CredentialType string
+	Domain         string
+	Role           string
+	CreatedAt      time.Time
+
+	// Vault does not pass the lease ID to the plugin. LeasePrefix is the path
+	// the lease ID starts with.
+	LeasePrefix string
+
+	EntityID    string
+	DisplayName string
+
+	// LastUsedAt is the time of the last message sent with the credential
+	// the plugin learned of.
+	LastUsedAt time.Time
+	// LastCheckedAt is the time the events of the credential were last
+	// polled by the monitor.
+	LastCheckedAt time.Time
+	// IdleAt is the time the monitor found the credential idle, zero if it
+	// was used since.
+	IdleAt time.Time
+
+	// ReportedEvents are the events of the abuse window received by the
+	// webhook.
+	ReportedEvents []reportedEvent
+
+	RevokedAt     time.Time
+	RevokedReason string
+}
+
+// newInventoryEntry returns the entry for a credential issued by req.
+func newInventoryEntry(req *logical.Request, username, credentialType, domain, roleName string) *inventoryEntry {
+	return &inventoryEntry{
+		Username:       username,
+		CredentialType: credentialType,
+		Domain:         domain,
+		Role:           roleName,
+		CreatedAt:      time.Now(),
+		LeasePrefix:    req.MountPoint + req.Path,
+		EntityID:       req.EntityID,
+		DisplayName:    req.DisplayName,
+	}
+}
+
+// lastActive returns the time the credential was last used, or created if it
+// was not used yet.
+func (entry *inventoryEntry) lastActive() time.Time {
+	if entry.LastUsedAt.After(entry.CreatedAt) {
+		return entry.LastUsedAt
+	}
+	return entry.CreatedAt
+}
+
+func (entry *inventoryEntry) revoked() bool {
+	return !entry.RevokedAt.IsZero()
+}
+
+// inventoryLock returns the lock of the inventory entry of username.
+func (b *mailgunBackend) inventoryLock(username string) *locksutil.LockEntry {
+	return locksutil.LockForKey(b.inventoryLocks, strings.ToLower(username))
+}
+
+// markInventoryRevoked records the revocation of the credential and its reason.
+// Credentials issued before the inventory was kept have no entry and are
+// skipped.
+func markInventoryRevoked(ctx context.Context, s logical.Storage, username string, reason string) error {
+	entry, err := getInventoryEntry(ctx, s, username)
+	if err != nil || entry == nil {
+		return err
+	}
+	entry.RevokedAt = time.Now()
+	entry.RevokedReason = reason
+	return putInventoryEntry(ctx, s, entry)
+}
+
+// pruneInventory deletes the entries of credentials revoked longer than the
+// inventory retention of the config ago. Entries stored with an upper case
+// key are moved to their lower case key.
+func (b *mailgunBackend) pruneInventory(ctx context.Context, s logical.Storage) error {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	retention := defaultInventoryRetention
+	if config != nil {
+		retention = config.inventoryRetention()
+	}
+
+	entries, err := listInventory(ctx, s)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.revoked() || time.Since(entry.RevokedAt) < retention {
+			if key, legacyKey := inventoryKey(entry.Username); key != legacyKey {
+				lock := b.inventoryLock(entry.Username)
+				lock.Lock()
+				err := putInventoryEntry(ctx, s, entry)
+				lock.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := deleteInventoryEntry(ctx, s, entry.Username); err != nil {
+			return err
+		}
+		b.Logger().Debug("pruned revoked credential from inventory", "username", entry.Username, "revoked_at", entry.RevokedAt)
+	}
+	return nil
+}
+
+func listInventory(ctx context.Context, s logical.Storage) ([]*inventoryEntry, error) {
+	usernames, err := s.List(ctx, inventoryStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*inventoryEntry, 0, len(usernames))
+	for _, username := range usernames {
+		entry, err := getInventoryEntry(ctx, s, username)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// inventoryKey returns the storage key of the entry of username. SMTP logins
+// and list addresses are case insensitive, the key is lower case. Entries of
+// mailing lists were stored with the case of the configured domain before,
+// legacyKey returns their key.
+func inventoryKey(username string) (key, legacyKey string) {
+	return inventoryStoragePrefix + strings.ToLower(username), inventoryStoragePrefix + username
+}
+
+func getInventoryEntry(ctx context.Context, s logical.Storage, username string) (*inventoryEntry, error) {
+	var entry inventoryEntry
+	key, legacyKey := inventoryKey(username)
+	entryRaw, err := s.Get(ctx, key)
+	if err == nil && entryRaw == nil && legacyKey != key {
+		entryRaw, err = s.Get(ctx, legacyKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entryRaw == nil {
+		return nil, nil
+	}
+
+	if err := entryRaw.DecodeJSON(&entry); err != nil {
+		return nil, fmt.Errorf("unable to decode inventory entry %s: %v", username, err)
+	}
+	// Entries written before mailing lists were tracked.
+	if entry.CredentialType == "" {
+		entry.CredentialType = credentialTypeSmtp
+	}
+
+	return &entry, nil
+}
+
+func putInventoryEntry(ctx context.Context, s logical.Storage, entry *inventoryEntry) error {
+	key, legacyKey := inventoryKey(entry.Username)
+	storageEntry, err := logical.StorageEntryJSON(key, entry)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, storageEntry); err != nil {
+		return err
+	}
+	if legacyKey != key {
+		return s.Delete(ctx, legacyKey)
+	}
+	return nil
+}
+
+func deleteInventoryEntry(ctx context.Context, s logical.Storage, username string) error {
+	key, legacyKey := inventoryKey(username)
+	if err := s.Delete(ctx, key); err != nil {
+		return err
+	}
+	if legacyKey != key {
+		return s.Delete(ctx, legacyKey)
+	}
+	return nil
+}
+
+const pathInventoryHelpSyn = `
+List and read the credentials issued by this mount.
+`
+
+const pathInventoryHelpDesc = `
+Every SMTP login and mailing list issued by this mount is recorded with its
+domain, role, the entity and display name of the requester and the time it
+was created. Revoking the lease marks the credential as revoked, the entry is
+kept for the "inventory_retention" of the config (default 30 days).
+
+Vault does not pass the lease ID to the plugin. "lease_prefix" is the path the
+lease ID starts with.
+`
@@ -0,0 +1,188 @@
+package mgsecret
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInventory(t *testing.T) {
+	t.Run("issued credentials are recorded with the requester", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:     storage,
+			Operation:   logical.ReadOperation,
+			Path:        "credentials",
+			MountPoint:  "mailgun/",
+			EntityID:    "entity-1",
+			DisplayName: "token-ci",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		username := resp.Secret.InternalData[internalDataUser].(string)
+
+		list := listInventoryRequest(t, b, storage)
+		keys := list.Data["keys"].([]string)
+		if len(keys) != 1 || keys[0] != username {
+			t.Fatal("inventory should contain", username, "but contains", keys)
+		}
+		info := list.Data["key_info"].(map[string]interface{})[username].(map[string]interface{})
+		if info["credential_type"] != credentialTypeSmtp || info["revoked"] != false {
+			t.Error("Unexpected key_info:", info)
+		}
+
+		data := readInventory(username, t, b, storage).Data
+		expected := map[string]interface{}{
+			"domain":       "example.com",
+			"entity_id":    "entity-1",
+			"display_name": "token-ci",
+			"lease_prefix": "mailgun/credentials",
+			"revoked":      false,
+		}
+		for key, value := range expected {
+			if data[key] != value {
+				t.Errorf("%s should be %v but is %v", key, value, data[key])
+			}
+		}
+		if data["created_at"] == "" {
+			t.Error("created_at should be set")
+		}
+	})
+
+	t.Run("revoking the lease marks the credential as revoked", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		resp := requestCredentials(t, b, storage)
+		username := resp.Secret.InternalData[internalDataUser].(string)
+
+		revokeSecret(resp.Secret, t, b, storage)
+
+		data := readInventory(username, t, b, storage).Data
+		if data["revoked"] != true || data["revoked_at"] == "" {
+			t.Error("credential should be marked as revoked:", data)
+		}
+	})
+
+	t.Run("revoking a revoked credential does nothing", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		resp := requestCredentials(t, b, storage)
+		revokeSecret(resp.Secret, t, b, storage)
+		username := resp.Secret.InternalData[internalDataUser].(string)
+		testClient(b).deleteErrors[username] = fmt.Errorf("already deleted")
+
+		if resp := revokeSecret(resp.Secret, t, b, storage); resp.IsError() {
+			t.Error("Unexpected error:", resp.Error())
+		}
+	})
+
+	t.Run("mailing lists are recorded", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("lists", map[string]interface{}{
+			"credential_type": credentialTypeMailingList,
+		}, t, b, storage)
+		resp := requestRoleCredentials("lists", nil, t, b, storage)
+		address := resp.Data["address"].(string)
+
+		data := readInventory(address, t, b, storage).Data
+		if data["credential_type"] != credentialTypeMailingList || data["role"] != "lists" {
+			t.Error("Unexpected inventory entry:", data)
+		}
+
+		revokeSecret(resp.Secret, t, b, storage)
+		if data := readInventory(address, t, b, storage).Data; data["revoked"] != true {
+			t.Error("mailing list should be marked as revoked")
+		}
+	})
+
+	t.Run("revoked credentials are pruned after the retention", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeConfig(map[string]interface{}{"inventory_retention": "1h"}, t, b, storage)
+		expired := requestCredentials(t, b, storage)
+		recent := requestCredentials(t, b, storage)
+		active := requestCredentials(t, b, storage)
+		revokeSecret(expired.Secret, t, b, storage)
+		revokeSecret(recent.Secret, t, b, storage)
+		expiredUsername := expired.Secret.InternalData[internalDataUser].(string)
+		entry, err := getInventoryEntry(context.Background(), storage, expiredUsername)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.RevokedAt = time.Now().Add(-2 * time.Hour)
+		if err := putInventoryEntry(context.Background(), storage, entry); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err != nil {
+			t.Fatal(err)
+		}
+
+		if entry, _ := getInventoryEntry(context.Background(), storage, expiredUsername); entry != nil {
+			t.Error("Expired entry was not pruned:", entry)
+		}
+		for _, kept := range []*logical.Response{recent, active} {
+			username := kept.Secret.InternalData[internalDataUser].(string)
+			if entry, _ := getInventoryEntry(context.Background(), storage, username); entry == nil {
+				t.Error("Entry was pruned before the retention:", username)
+			}
+		}
+	})
+}
+
+func listInventoryRequest(t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ListOperation,
+		Path:      "creds-inventory/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func readInventory(username string, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "creds-inventory/" + username,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil {
+		t.Fatal("credential", username, "is not in the inventory")
+	}
+	return resp
+}
+
+// failingStorage fails to store entries with keys starting with prefix, with
+// err or a generic error.
+type failingStorage struct {
+	logical.Storage
+	prefix string
+	err    error
+}
+
+func (s *failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) && s.err != nil {
+		return s.err
+	}
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Put(ctx, entry)
+}
@@ -0,0 +1,555 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	secretTypeLibraryCredential = "library_credential"
+	libraryStoragePrefix        = "library/"
+	internalDataCheckOutID      = "check_out_id"
+)
+
+func pathLibraryCheckOut(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "library/" + framework.GenericNameRegex("role") + "/check-out$",
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "Name of the library role.",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Requested Time to live (TTL) of the check-out. Capped at the max_ttl.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.pathLibraryCheckOut,
+				Summary:   "Check out an SMTP login of the library.",
+				Responses: operationResponses(http.StatusOK, "An SMTP login of the library with a new password and a lease.", smtpCredentialExample, http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathLibraryHelpSyn,
+		HelpDescription: pathLibraryHelpDesc,
+	}
+}
+
+func pathLibraryCheckIn(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "library/" + framework.GenericNameRegex("role") + "/check-in$",
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "Name of the library role.",
+			},
+			"username": {
+				Type:        framework.TypeString,
+				Description: "Required. The checked out SMTP username.",
+				Required:    true,
+			},
+			"check_out_id": {
+				Type:        framework.TypeString,
+				Description: "Required. The check_out_id returned by the check-out.",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.pathLibraryCheckIn,
+				Summary:   "Return a checked out SMTP login to the library.",
+				Responses: noContentResponses("The password of the SMTP login is changed and it is available again.", http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathLibraryHelpSyn,
+		HelpDescription: pathLibraryHelpDesc,
+	}
+}
+
+func pathLibraryStatus(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "library/" + framework.GenericNameRegex("role") + "/status$",
+		Fields: map[string]*framework.FieldSchema{
+			"role": {
+				Type:        framework.TypeString,
+				Description: "Name of the library role.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathLibraryStatus,
+				Summary:  "Return the state of the SMTP logins in the library.",
+				Responses: operationResponses(http.StatusOK, "The number of SMTP logins per state.", map[string]interface{}{
+					"library_size": 5,
+					"available":    3,
+					"propagating":  1,
+					"checked_out":  1,
+				}, http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathLibraryHelpSyn,
+		HelpDescription: pathLibraryHelpDesc,
+	}
+}
+
+func secretLibraryCredential(b *mailgunBackend) *framework.Secret {
+	return &framework.Secret{
+		Type:   secretTypeLibraryCredential,
+		Fields: libraryCredentialFields(),
+		Renew:  b.secretLibraryCredentialRenew,
+		Revoke: b.secretLibraryCredentialRevoke,
+	}
+}
+
+func (b *mailgunBackend) secretLibraryCredentialRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+	r, resp, err := getLeaseRole(ctx, req.Storage, req)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	username, ok := req.Secret.InternalData[internalDataUser].(string)
+	if !ok {
+		return nil, fmt.Errorf("no internal user name found")
+	}
+	roleName, _ := req.Secret.InternalData[internalDataRole].(string)
+	checkOutID, _ := req.Secret.InternalData[internalDataCheckOutID].(string)
+
+	op := b.startLeaseOperation(operationRenew, req, config, r)
+	entry, err := getLibraryEntry(ctx, req.Storage, roleName, username)
+	if err != nil {
+		op.failed(errorClassStorage, err)
+		return nil, err
+	}
+	if entry == nil || !entry.CheckedOut || entry.CheckOutID != checkOutID {
+		err := fmt.Errorf("SMTP login '%s' is not checked out with this lease any longer", username)
+		op.failed(errorClassNotFound, err)
+		return logical.ErrorResponse(err.Error() + "."), nil
+	}
+	if resp := b.checkLoginExists(op, config, username); resp != nil {
+		return resp, nil
+	}
+	return b.renewLease(op, req, config, r)
+}
+
+func (b *mailgunBackend) secretLibraryCredentialRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	username, ok := req.Secret.InternalData[internalDataUser]
+	if !ok {
+		return nil, fmt.Errorf("no internal user name found")
+	}
+	roleName, ok := req.Secret.InternalData[internalDataRole]
+	if !ok {
+		return nil, fmt.Errorf("no internal role found")
+	}
+	// Leases issued before check-out IDs were recorded have none.
+	checkOutID, _ := req.Secret.InternalData[internalDataCheckOutID].(string)
+
+	entry, err := getLibraryEntry(ctx, req.Storage, roleName.(string), username.(string))
+	if err != nil {
+		return nil, err
+	}
+	// The login was checked in already, possibly checked out again by
+	// someone else. The lease has nothing left to revoke.
+	if entry == nil || !entry.CheckedOut || entry.CheckOutID != checkOutID {
+		return nil, nil
+	}
+
+	return b.checkIn(ctx, req.Storage, roleName.(string), username.(string), checkOutID, revokedReasonLease)
+}
+
+func libraryCredentialFields() map[string]*framework.FieldSchema {
+	fields := smtpCredentialFields()
+	fields["check_out_id"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The ID of the check-out, required to check the login in.",
+	}
+	return fields
+}
+
+func (b *mailgunBackend) pathLibraryCheckOut(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	roleName := data.Get("role").(string)
+	r, resp, err := getLibraryRole(ctx, req.Storage, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+
+	entries, err := listLibrary(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	var available *libraryEntry
+	for _, entry := range entries {
+		if !entry.CheckedOut && time.Since(entry.CreatedAt) >= r.LibraryPropagationDelay {
+			available = entry
+			break
+		}
+	}
+	if available == nil {
+		return logical.ErrorResponse(fmt.Sprintf("No SMTP login of role '%s' is available. Try again later.", roleName)), nil
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+	checkOutID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	op := b.startOperation(operationCreate, credentialTypeLibrary, roleName, config.Domain, available.Login)
+	client := b.client(config)
+	if err = client.ChangeCredentialPassword(available.Login, password); err != nil {
+		op.failed(classifyError(err), err)
+		return logical.ErrorResponse(fmt.Sprintf("Unable to change password in mailgun: %v", err)), nil
+	}
+
+	available.CheckedOut = true
+	available.CheckedOutAt = time.Now()
+	available.CheckOutID = checkOutID
+	if err := putLibraryEntry(ctx, req.Storage, roleName, available); err != nil {
+		op.failed(errorClassStorage, err)
+		return nil, err
+	}
+	err = putInventoryEntry(ctx, req.Storage, newInventoryEntry(req, available.Login, credentialTypeLibrary, config.Domain, roleName))
+	if err != nil {
+		op.failed(errorClassStorage, err)
+		return nil, err
+	}
+	op.succeeded()
+
+	address := fmt.Sprintf("%s@%s", available.Login, config.Domain)
+	secretD := smtpConnectionData(config, address, password, r.OutputFormats)
+	secretD["username"] = address
+	secretD["password"] = password
+	secretD["check_out_id"] = checkOutID
+	internalD := map[string]interface{}{
+		internalDataUser:       available.Login,
+		internalDataRole:       roleName,
+		internalDataCheckOutID: checkOutID,
+	}
+
+	secret := b.Secret(secretTypeLibraryCredential)
+	resp = secret.Response(secretD, internalD)
+	resp.Secret.TTL, resp.Secret.MaxTTL = r.leaseTTLs(config)
+	resp.Secret.Renewable = true
+	b.applyRequestedTTL(resp, data)
+	return resp, nil
+}
+
+func (b *mailgunBackend) pathLibraryCheckIn(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	username, resp := getFieldString("username", data)
+	if resp != nil {
+		return resp, nil
+	}
+	checkOutID, resp := getFieldString("check_out_id", data)
+	if resp != nil {
+		return resp, nil
+	}
+	roleName := data.Get("role").(string)
+	if _, resp, err := getLibraryRole(ctx, req.Storage, roleName); resp != nil || err != nil {
+		return resp, err
+	}
+
+	return b.checkIn(ctx, req.Storage, roleName, strings.SplitN(username, "@", 2)[0], checkOutID, revokedReasonCheckIn)
+}
+
+func (b *mailgunBackend) pathLibraryStatus(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roleName := data.Get("role").(string)
+	r, resp, err := getLibraryRole(ctx, req.Storage, roleName)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	entries, err := listLibrary(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	available, propagating, checkedOut := 0, 0, 0
+	for _, entry := range entries {
+		switch {
+		case entry.CheckedOut:
+			checkedOut++
+		case time.Since(entry.CreatedAt) < r.LibraryPropagationDelay:
+			propagating++
+		default:
+			available++
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"library_size": r.LibrarySize,
+			"available":    available,
+			"propagating":  propagating,
+			"checked_out":  checkedOut,
+		},
+	}, nil
+}
+
+// checkIn rotates the password of a checked out login and returns it to the
+// pool, so the previous holder cannot use it any longer. checkOutID must be
+// the ID of the current check-out.
+func (b *mailgunBackend) checkIn(ctx context.Context, s logical.Storage, roleName, login, checkOutID, reason string) (*logical.Response, error) {
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+
+	entry, err := getLibraryEntry(ctx, s, roleName, login)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		// The login was removed from the pool, e.g. by deleting the role.
+		return nil, nil
+	}
+	if !entry.CheckedOut {
+		return logical.ErrorResponse(fmt.Sprintf("SMTP login '%s' is not checked out.", login)), nil
+	}
+	if entry.CheckOutID != checkOutID {
+		return logical.ErrorResponse(fmt.Sprintf("SMTP login '%s' is checked out with a different check_out_id.", login)), nil
+	}
+
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to get configuration: {{err}}", err)
+	}
+	if config == nil {
+		// Without a config the password cannot be rotated any longer.
+		// Failing would only keep the lease around forever. The login gets
+		// a new password when it is checked out again.
+		b.Logger().Warn("config deleted, password of checked in SMTP login is not rotated", "role", roleName, "username", login)
+		return nil, returnToLibrary(ctx, s, roleName, entry, reason)
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+	op := b.startOperation(operationDelete, credentialTypeLibrary, roleName, config.Domain, login)
+	client := b.client(config)
+	if err = client.ChangeCredentialPassword(login, password); err != nil {
+		op.failed(classifyError(err), err)
+		return logical.ErrorResponse(fmt.Sprintf("Unable to change password in mailgun: %v", err)), nil
+	}
+
+	if err := returnToLibrary(ctx, s, roleName, entry, reason); err != nil {
+		op.failed(errorClassStorage, err)
+		return nil, err
+	}
+	op.succeeded()
+	return nil, nil
+}
+
+// returnToLibrary marks the login of entry as checked in and its inventory
+// entry as revoked.
+func returnToLibrary(ctx context.Context, s logical.Storage, roleName string, entry *libraryEntry, reason string) error {
+	entry.CheckedOut = false
+	entry.CheckedOutAt = time.Time{}
+	entry.CheckOutID = ""
+	if err := putLibraryEntry(ctx, s, roleName, entry); err != nil {
+		return err
+	}
+	return markInventoryRevoked(ctx, s, entry.Login, reason)
+}
+
+// refillLibraries creates new SMTP logins until every library role has
+// library_size logins which are not checked out.
+func (b *mailgunBackend) refillLibraries(ctx context.Context, s logical.Storage) error {
+	config, err := getConfig(ctx, s)
+	if err != nil {
+		return errwrap.Wrapf("Unable to get configuration: {{err}}", err)
+	}
+	if config == nil {
+		return nil
+	}
+
+	roleNames, err := s.List(ctx, rolesStoragePrefix)
+	if err != nil {
+		return err
+	}
+
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+
+	client := b.client(config)
+	for _, roleName := range roleNames {
+		r, err := getRole(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		if r == nil || r.CredentialType != credentialTypeLibrary {
+			continue
+		}
+
+		entries, err := listLibrary(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		inPool := 0
+		for _, entry := range entries {
+			if !entry.CheckedOut {
+				inPool++
+			}
+		}
+
+		for ; inPool < r.LibrarySize; inPool++ {
+			login, err := generateUsername()
+			if err != nil {
+				return err
+			}
+			password, err := generatePassword()
+			if err != nil {
+				return err
+			}
+			if err := client.CreateCredential(login, password); err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("Unable to create SMTP login for library role '%s': {{err}}", roleName), err)
+			}
+			if err := putLibraryEntry(ctx, s, roleName, &libraryEntry{Login: login, CreatedAt: time.Now()}); err != nil {
+				// A login missing in the pool would never be deleted.
+				if deleteErr := client.DeleteCredential(login); deleteErr != nil {
+					return multierror.Append(err, fmt.Errorf("unable to delete SMTP login %s: %v", login, deleteErr))
+				}
+				return err
+			}
+			b.Logger().Debug("added SMTP login to library", "role", roleName, "domain", config.Domain, "username", login)
+		}
+	}
+	return nil
+}
+
+// emptyLibrary deletes all SMTP logins of a library role. It refuses to do
+// so while logins are checked out.
+func (b *mailgunBackend) emptyLibrary(ctx context.Context, s logical.Storage, roleName string) (*logical.Response, error) {
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+
+	entries, err := listLibrary(ctx, s, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	for _, entry := range entries {
+		if entry.CheckedOut {
+			return logical.ErrorResponse(fmt.Sprintf("SMTP login '%s' of role '%s' is still checked out.", entry.Login, roleName)), nil
+		}
+	}
+
+	config, err := getConfig(ctx, s)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+	client := b.client(config)
+	for _, entry := range entries {
+		if err := client.DeleteCredential(entry.Login); err != nil {
+			b.Logger().Error("failed to delete SMTP login of library", "role", roleName, "domain", config.Domain, "username", entry.Login, "error", err)
+			return logical.ErrorResponse(fmt.Sprintf("Unable to delete SMTP login '%s' in mailgun: %v", entry.Login, err)), nil
+		}
+		if err := s.Delete(ctx, libraryEntryKey(roleName, entry.Login)); err != nil {
+			return nil, err
+		}
+	}
+	b.Logger().Info("emptied library", "role", roleName, "domain", config.Domain, "deleted", len(entries))
+	return nil, nil
+}
+
+type libraryEntry struct {
+	Login        string
+	CreatedAt    time.Time
+	CheckedOut   bool
+	CheckedOutAt time.Time
+
+	// CheckOutID identifies the current check-out, so only its holder can
+	// check the login in.
+	CheckOutID string
+}
+
+func getLibraryRole(ctx context.Context, s logical.Storage, roleName string) (*role, *logical.Response, error) {
+	r, err := getRole(ctx, s, roleName)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("Unable to get role: {{err}}", err)
+	}
+	if r == nil || r.CredentialType != credentialTypeLibrary {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Role '%s' is not a library role.", roleName)), nil
+	}
+	return r, nil, nil
+}
+
+func libraryEntryKey(roleName, login string) string {
+	return libraryStoragePrefix + roleName + "/" + login
+}
+
+func listLibrary(ctx context.Context, s logical.Storage, roleName string) ([]*libraryEntry, error) {
+	logins, err := s.List(ctx, libraryStoragePrefix+roleName+"/")
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*libraryEntry, 0, len(logins))
+	for _, login := range logins {
+		entry, err := getLibraryEntry(ctx, s, roleName, login)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func getLibraryEntry(ctx context.Context, s logical.Storage, roleName, login string) (*libraryEntry, error) {
+	var entry libraryEntry
+	entryRaw, err := s.Get(ctx, libraryEntryKey(roleName, login))
+	if err != nil {
+		return nil, err
+	}
+	if entryRaw == nil {
+		return nil, nil
+	}
+
+	if err := entryRaw.DecodeJSON(&entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func putLibraryEntry(ctx context.Context, s logical.Storage, roleName string, entry *libraryEntry) error {
+	storageEntry, err := logical.StorageEntryJSON(libraryEntryKey(roleName, entry.Login), entry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, storageEntry)
+}
+
+const pathLibraryHelpSyn = `
+Check SMTP logins of a library role out and in.
+`
+
+const pathLibraryHelpDesc = `
+A library role keeps a pool of "library_size" pre-created SMTP logins, so
+callers get a login that Mailgun already accepts. A login is only handed out
+after it existed for "library_propagation_delay". "check-out" returns a login
+with a freshly rotated password and a "check_out_id". "check-in" with that ID
+or the expiry of the lease rotates the password again and returns the login to
+the pool. The pool is refilled in the background.
+`
@@ -0,0 +1,259 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"strings"
+	"testing"
+)
+
+func TestLibrary(t *testing.T) {
+	t.Run("periodic function fills the pool", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+
+		status := requestLibraryStatus(t, b, storage)
+
+		if available := status.Data["available"]; available != 2 {
+			t.Error("Expected 2 available logins, but was", available)
+		}
+		if len(testClient(b).credentials) != 2 {
+			t.Error("Expected 2 logins in mailgun, but was", testClient(b).credentials)
+		}
+	})
+
+	t.Run("logins that cannot be added to the pool are deleted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("pool", map[string]interface{}{
+			"credential_type": credentialTypeLibrary,
+			"library_size":    2,
+		}, t, b, storage)
+
+		err := b.refillLibraries(context.Background(), &failingStorage{Storage: storage, prefix: libraryStoragePrefix})
+
+		if err == nil {
+			t.Error("storage error should be returned")
+		}
+		if logins := testClient(b).credentials; len(logins) != 0 {
+			t.Error("login should be deleted in mailgun:", logins)
+		}
+	})
+
+	t.Run("propagating logins are not checked out", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "1h")
+
+		resp := libraryRequest("check-out", nil, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("Login was checked out before it propagated:", resp.Data)
+		}
+		if propagating := requestLibraryStatus(t, b, storage).Data["propagating"]; propagating != 2 {
+			t.Error("Expected 2 propagating logins, but was", propagating)
+		}
+	})
+
+	t.Run("check-out rotates password", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+
+		resp := libraryRequest("check-out", nil, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Check-out failed:", resp.Error())
+		}
+		username := resp.Data["username"].(string)
+		login := strings.TrimSuffix(username, "@example.com")
+		if testClient(b).credentials[login] != resp.Data["password"] {
+			t.Error("Password of", username, "was not rotated")
+		}
+		if checkedOut := requestLibraryStatus(t, b, storage).Data["checked_out"]; checkedOut != 1 {
+			t.Error("Expected 1 checked out login, but was", checkedOut)
+		}
+	})
+
+	t.Run("check-in rotates password and returns login to pool", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+
+		resp := libraryRequest("check-in", map[string]interface{}{
+			"username":     checkedOut.Data["username"],
+			"check_out_id": checkedOut.Data["check_out_id"],
+		}, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Check-in failed:", resp.Error())
+		}
+		login := strings.TrimSuffix(checkedOut.Data["username"].(string), "@example.com")
+		if testClient(b).credentials[login] == checkedOut.Data["password"] {
+			t.Error("Password was not rotated on check-in")
+		}
+		if available := requestLibraryStatus(t, b, storage).Data["available"]; available != 2 {
+			t.Error("Expected 2 available logins, but was", available)
+		}
+	})
+
+	t.Run("check-in requires the check-out ID", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+
+		resp := libraryRequest("check-in", map[string]interface{}{
+			"username":     checkedOut.Data["username"],
+			"check_out_id": "someone-else",
+		}, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("Login was checked in with a wrong check_out_id")
+		}
+		login := strings.TrimSuffix(checkedOut.Data["username"].(string), "@example.com")
+		if testClient(b).credentials[login] != checkedOut.Data["password"] {
+			t.Error("Password was rotated by a wrong check_out_id")
+		}
+	})
+
+	t.Run("check-out is recorded in the inventory", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+		login := strings.TrimSuffix(checkedOut.Data["username"].(string), "@example.com")
+
+		resp := readInventory(login, t, b, storage)
+
+		if resp == nil || resp.Data["credential_type"] != credentialTypeLibrary || resp.Data["role"] != "pool" {
+			t.Fatal("Check-out was not recorded in the inventory:", resp)
+		}
+		libraryRequest("check-in", map[string]interface{}{
+			"username":     checkedOut.Data["username"],
+			"check_out_id": checkedOut.Data["check_out_id"],
+		}, t, b, storage)
+		if resp := readInventory(login, t, b, storage); resp.Data["revoked_reason"] != revokedReasonCheckIn {
+			t.Error("Check-in was not recorded in the inventory:", resp.Data)
+		}
+	})
+
+	t.Run("lease expiry returns login to pool", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    checkedOut.Secret,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if available := requestLibraryStatus(t, b, storage).Data["available"]; available != 2 {
+			t.Error("Expected 2 available logins, but was", available)
+		}
+	})
+
+	t.Run("revoking without config returns login to pool", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+		deleteConfig(nil, t, b, storage)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    checkedOut.Secret,
+		})
+		if err != nil || resp.IsError() {
+			t.Fatal("Revoke failed:", resp, err)
+		}
+
+		if checkedOut := requestLibraryStatus(t, b, storage).Data["checked_out"]; checkedOut != 0 {
+			t.Error("Expected no checked out logins, but was", checkedOut)
+		}
+		login := checkedOut.Secret.InternalData[internalDataUser].(string)
+		if entry, _ := getInventoryEntry(context.Background(), storage, login); entry == nil || !entry.revoked() {
+			t.Error("Inventory entry was not marked revoked:", entry)
+		}
+	})
+
+	t.Run("revoking a checked in lease does not rotate the password", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+		libraryRequest("check-in", map[string]interface{}{
+			"username":     checkedOut.Data["username"],
+			"check_out_id": checkedOut.Data["check_out_id"],
+		}, t, b, storage)
+		login := strings.TrimSuffix(checkedOut.Data["username"].(string), "@example.com")
+		password := testClient(b).credentials[login]
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    checkedOut.Secret,
+		})
+		if err != nil || resp.IsError() {
+			t.Fatal("Revoke failed:", resp, err)
+		}
+
+		if testClient(b).credentials[login] != password {
+			t.Error("Revoke rotated the password of a checked in login")
+		}
+	})
+
+	t.Run("checked out logins are replaced", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		libraryRequest("check-out", nil, t, b, storage)
+
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err != nil {
+			t.Fatal(err)
+		}
+
+		status := requestLibraryStatus(t, b, storage)
+		if status.Data["available"] != 2 || status.Data["checked_out"] != 1 {
+			t.Error("Unexpected library status:", status.Data)
+		}
+	})
+}
+
+func testLibraryBackend(t *testing.T, propagationDelay string) (*mailgunBackend, logical.Storage) {
+	b, storage := testBackend(t)
+	storeDefaultConfig(t, b, storage)
+	storeRole("pool", map[string]interface{}{
+		"credential_type":           credentialTypeLibrary,
+		"library_size":              2,
+		"library_propagation_delay": propagationDelay,
+	}, t, b, storage)
+	if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	return b, storage
+}
+
+func requestLibraryStatus(t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "library/pool/status",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func libraryRequest(operation string, data map[string]interface{}, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "library/pool/" + operation,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
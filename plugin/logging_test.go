@@ -0,0 +1,147 @@
+package mgsecret
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/logical"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogging(t *testing.T) {
+	t.Run("credential events are logged without password", func(t *testing.T) {
+		t.Parallel()
+		b, storage, logs := testLoggingBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		resp := requestCredentials(t, b, storage)
+		revokeSecret(resp.Secret, t, b, storage)
+
+		username := resp.Secret.InternalData[internalDataUser].(string)
+		output := logs.String()
+		for _, expected := range []string{"created credential", "revoked credential", "username=" + username, "domain=example.com"} {
+			if !strings.Contains(output, expected) {
+				t.Errorf("log should contain %q but is:\n%s", expected, output)
+			}
+		}
+		if strings.Contains(output, resp.Data["password"].(string)) {
+			t.Error("log contains the password:", output)
+		}
+	})
+
+	t.Run("failed revoke is logged as error", func(t *testing.T) {
+		t.Parallel()
+		b, storage, logs := testLoggingBackend(t)
+		storeDefaultConfig(t, b, storage)
+		resp := requestCredentials(t, b, storage)
+		username := resp.Secret.InternalData[internalDataUser].(string)
+		testClient(b).deleteErrors[username] = fmt.Errorf("mailgun unavailable")
+
+		revokeSecret(resp.Secret, t, b, storage)
+
+		output := logs.String()
+		if !strings.Contains(output, "[ERROR] failed to revoke credential") || !strings.Contains(output, "mailgun unavailable") {
+			t.Error("failed revoke was not logged:", output)
+		}
+	})
+
+	t.Run("requests are traced with verbose logging", func(t *testing.T) {
+		t.Parallel()
+		b, storage, logs := testLoggingBackend(t)
+		storeDefaultConfig(t, b, storage)
+		requestCredentials(t, b, storage)
+		if strings.Contains(logs.String(), "handled request") {
+			t.Fatal("requests should not be traced by default")
+		}
+
+		storeConfig(map[string]interface{}{"verbose_logging": true}, t, b, storage)
+		requestCredentials(t, b, storage)
+
+		if output := logs.String(); !strings.Contains(output, "handled request: operation=read path=credentials") {
+			t.Error("request was not traced:", output)
+		}
+	})
+
+	t.Run("mailgun api requests are traced without api key", func(t *testing.T) {
+		t.Parallel()
+		server, _ := startMailgunStandIn("secret-api-key")
+		defer server.Close()
+		logs := &syncBuffer{}
+		client := DefaultMailgunClientFactory("example.com", "secret-api-key")
+		client.(apiBaseSetter).SetAPIBase(server.URL)
+		withRequestTracing(client, testLogger(logs))
+
+		client.IsApiKeyValid()
+
+		output := logs.String()
+		if !strings.Contains(output, "mailgun api request: method=GET url="+server.URL+"/domains status=200") {
+			t.Error("mailgun api request was not traced:", output)
+		}
+		if strings.Contains(output, "secret-api-key") {
+			t.Error("log contains the api key:", output)
+		}
+	})
+
+	t.Run("addresses are not traced", func(t *testing.T) {
+		t.Parallel()
+		server, _ := startMailgunStandIn("secret-api-key")
+		defer server.Close()
+		logs := &syncBuffer{}
+		client := DefaultMailgunClientFactory("example.com", "secret-api-key")
+		client.(apiBaseSetter).SetAPIBase(server.URL)
+		withRequestTracing(client, testLogger(logs))
+
+		client.GetSingleBounce(escapeAddress("alice+news@example.org"))
+		client.GetListByAddress("team@example.com")
+
+		output := logs.String()
+		if !strings.Contains(output, "url="+server.URL+"/example.com/bounces/redacted ") {
+			t.Error("bounce request was not traced redacted:", output)
+		}
+		if strings.Contains(output, "alice") || strings.Contains(output, "team@") {
+			t.Error("log contains an address:", output)
+		}
+	})
+}
+
+// testLoggingBackend returns a test backend that logs into the returned
+// buffer.
+func testLoggingBackend(t *testing.T) (*mailgunBackend, logical.Storage, *syncBuffer) {
+	t.Helper()
+	logs := &syncBuffer{}
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.Logger = testLogger(logs)
+
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := b.(*mailgunBackend)
+	backend.MailgunFactory = generateMailgunClientFactory(true, true)
+	return backend, config.StorageView, logs
+}
+
+func testLogger(logs *syncBuffer) log.Logger {
+	return log.New(&log.LoggerOptions{Output: logs, Level: log.Trace})
+}
+
+type syncBuffer struct {
+	sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buffer.String()
+}
@@ -1,12 +1,52 @@
 package mgsecret
 
-import "github.com/mailgun/mailgun-go"
+import (
+	log "github.com/hashicorp/go-hclog"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// credentialsPageSize is the number of SMTP credentials requested per page.
+	credentialsPageSize = 100
+	// eventsPageSize is the number of events requested per page.
+	eventsPageSize = 300
+	// maxEventPages limits the pages of domain events searched for the
+	// events of a sender.
+	maxEventPages = 20
+	// credentialsCacheTTL is how long the SMTP logins of the domain are cached
+	// to check their existence on renewal.
+	credentialsCacheTTL = time.Minute
+)
 
 type MailgunClient interface {
 	IsDomainValid() bool
 	IsApiKeyValid() bool
 	DeleteCredential(username string) error
 	CreateCredential(login, password string) error
+	ChangeCredentialPassword(login, password string) error
+	ListAllCredentials() ([]mailgun.Credential, error)
+	CreateList(prototype mailgun.List) (mailgun.List, error)
+	CreateMemberList(subscribed *bool, address string, newMembers []interface{}) error
+	DeleteList(address string) error
+	GetListByAddress(address string) (mailgun.List, error)
+	ListSenderEvents(sender string, since time.Time, limit int) ([]mailgun.Event, error)
+
+	GetBounces(limit, skip int) (int, []mailgun.Bounce, error)
+	GetSingleBounce(address string) (mailgun.Bounce, error)
+	AddBounce(address, code, message string) error
+	DeleteBounce(address string) error
+	GetUnsubscribes(limit, skip int) (int, []mailgun.Unsubscription, error)
+	GetUnsubscribesByAddress(address string) (int, []mailgun.Unsubscription, error)
+	Unsubscribe(address, tag string) error
+	RemoveUnsubscribe(address string) error
+	GetComplaints(limit, skip int) (int, []mailgun.Complaint, error)
+	GetSingleComplaint(address string) (mailgun.Complaint, error)
+	CreateComplaint(address string) error
+	DeleteComplaint(address string) error
 }
 
 type mailgunClientImpl struct {
@@ -27,6 +67,196 @@ func (client mailgunClientImpl) IsDomainValid() bool {
 	return true
 }
 
+// ListAllCredentials returns the SMTP credentials of the domain from all pages.
+func (client mailgunClientImpl) ListAllCredentials() ([]mailgun.Credential, error) {
+	var all []mailgun.Credential
+	for skip := 0; ; skip += credentialsPageSize {
+		_, credentials, err := client.GetCredentials(credentialsPageSize, skip)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, credentials...)
+		if len(credentials) < credentialsPageSize {
+			return all, nil
+		}
+	}
+}
+
+// ListSenderEvents returns up to limit events of messages sent from sender
+// since the given time, newest first. The "from" filter of the events API
+// matches the From header, which the client chooses freely. The events of the
+// domain are filtered by eventSentBy instead, at most maxEventPages pages.
+func (client mailgunClientImpl) ListSenderEvents(sender string, since time.Time, limit int) ([]mailgun.Event, error) {
+	now := time.Now()
+	// Mailgun returns the events from begin to end, so begin is the newest.
+	it := client.ListEvents(&mailgun.EventsOptions{
+		Begin:           &now,
+		End:             &since,
+		ForceDescending: true,
+		Limit:           eventsPageSize,
+	})
+	var all, page []mailgun.Event
+	for pages := 0; len(all) < limit && pages < maxEventPages && it.Next(&page); pages++ {
+		for _, event := range page {
+			if eventSentBy(event, sender) {
+				all = append(all, event)
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if len(all) > limit {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+// eventSentBy reports whether the event belongs to a message of the SMTP
+// login address. Mailgun does not record the login in its events. The
+// envelope sender, the MAIL FROM of the SMTP session, is matched instead of
+// the From header, which is only part of the message. Events without envelope
+// are not attributed to any login.
+func eventSentBy(event mailgun.Event, address string) bool {
+	return event.Envelope != nil && event.Envelope.Sender != nil && strings.EqualFold(*event.Envelope.Sender, address)
+}
+
+// credentialsCache holds the SMTP logins of a domain requested from Mailgun.
+type credentialsCache struct {
+	domain    string
+	logins    map[string]bool
+	fetchedAt time.Time
+}
+
+// credentialExists checks whether the SMTP login exists in the domain. The
+// logins are cached for credentialsCacheTTL, so renewing many leases lists
+// them once. A login missing in the cache may have been created since, the
+// logins are listed again then. The lock is held while listing, concurrent
+// renewals wait for the same list instead of requesting it again.
+func (b *mailgunBackend) credentialExists(client MailgunClient, domain, address string) (bool, error) {
+	address = strings.ToLower(address)
+	b.credentialsLock.Lock()
+	defer b.credentialsLock.Unlock()
+
+	cached := b.credentialsCache
+	if cached != nil && cached.domain == domain && time.Since(cached.fetchedAt) < credentialsCacheTTL && cached.logins[address] {
+		return true, nil
+	}
+
+	credentials, err := client.ListAllCredentials()
+	if err != nil {
+		return false, err
+	}
+	cached = &credentialsCache{domain: domain, logins: map[string]bool{}, fetchedAt: time.Now()}
+	for _, credential := range credentials {
+		cached.logins[strings.ToLower(credential.Login)] = true
+	}
+	b.credentialsCache = cached
+	return cached.logins[address], nil
+}
+
+// apiBaseSetter is implemented by clients that support other API endpoints
+// than the default US one.
+type apiBaseSetter interface {
+	SetAPIBase(address string)
+}
+
+// client returns a Mailgun client for the configured domain, API keys and
+// region. Its calls are tracked in the health of the backend.
+func (b *mailgunBackend) client(config *config) MailgunClient {
+	client := b.clientForApiKey(config, config.ApiKey)
+	if config.VerboseLogging {
+		withRequestTracing(client, b.Logger())
+	}
+	if config.SecondaryApiKey != "" {
+		withSecondaryApiKey(client, config.SecondaryApiKey)
+	}
+	return healthTrackingClient{client: client, health: b.health}
+}
+
+// clientForApiKey returns a Mailgun client for the configured domain and
+// region that only uses the given API key.
+func (b *mailgunBackend) clientForApiKey(config *config, apiKey string) MailgunClient {
+	client := b.MailgunFactory(config.Domain, apiKey)
+	if setter, ok := client.(apiBaseSetter); ok {
+		setter.SetAPIBase(regionApiBase[config.region()])
+	}
+	return client
+}
+
+// httpClientSetter is implemented by clients whose HTTP client can be
+// replaced.
+type httpClientSetter interface {
+	Client() *http.Client
+	SetClient(client *http.Client)
+}
+
+// wrapTransport replaces the HTTP transport of the client with the one
+// returned by wrap. Clients that do not support it are not changed.
+func wrapTransport(client MailgunClient, wrap func(base http.RoundTripper) http.RoundTripper) {
+	setter, ok := client.(httpClientSetter)
+	if !ok {
+		return
+	}
+	httpClient := http.DefaultClient
+	if current := setter.Client(); current != nil {
+		httpClient = current
+	}
+	// The client may be shared, http.DefaultClient for example.
+	wrapped := *httpClient
+	wrapped.Transport = wrap(httpClient.Transport)
+	setter.SetClient(&wrapped)
+}
+
+func baseTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		return http.DefaultTransport
+	}
+	return base
+}
+
+// withRequestTracing makes the client log every request to the Mailgun API.
+func withRequestTracing(client MailgunClient, logger log.Logger) {
+	wrapTransport(client, func(base http.RoundTripper) http.RoundTripper {
+		return &tracingTransport{base: base, logger: logger}
+	})
+}
+
+// tracingTransport logs the method, URL, status and duration of requests.
+// Headers and bodies are not logged since they contain the API key and
+// passwords, the query and path segments with email addresses are not logged
+// either.
+type tracingTransport struct {
+	base   http.RoundTripper
+	logger log.Logger
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := baseTransport(t.base).RoundTrip(req)
+	duration := time.Since(start)
+	url := req.URL.Scheme + "://" + req.URL.Host + redactedPath(req.URL)
+	if err != nil {
+		t.logger.Info("mailgun api request failed", "method", req.Method, "url", url, "error", err, "duration", duration)
+		return resp, err
+	}
+	t.logger.Info("mailgun api request", "method", req.Method, "url", url, "status", resp.StatusCode, "duration", duration)
+	return resp, err
+}
+
+// redactedPath returns the path of u with the segments that contain an email
+// address replaced. Suppression and mailing list paths contain the addresses
+// of recipients and lists.
+func redactedPath(u *neturl.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if strings.Contains(segment, "@") || strings.Contains(strings.ToLower(segment), "%40") {
+			segments[i] = "redacted"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
 func DefaultMailgunClientFactory(domain, apiKey string) MailgunClient {
 	return mailgunClientImpl{mailgun.NewMailgun(domain, apiKey)}
 }
@@ -0,0 +1,175 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/helper/base62"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	secretTypeMailingList = "mailing_list"
+	internalDataList      = "list_address"
+)
+
+func secretMailingList(b *mailgunBackend) *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeMailingList,
+		Fields: map[string]*framework.FieldSchema{
+			"address": {
+				Type:        framework.TypeString,
+				Description: "The address of the mailing list.",
+			},
+		},
+		Renew:  b.secretMailingListRenew,
+		Revoke: b.secretMailingListRevoke,
+	}
+}
+
+func (b *mailgunBackend) secretMailingListRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+	r, resp, err := getLeaseRole(ctx, req.Storage, req)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	address, ok := req.Secret.InternalData[internalDataList].(string)
+	if !ok {
+		return nil, fmt.Errorf("no internal list address found")
+	}
+
+	op := b.startLeaseOperation(operationRenew, req, config, r)
+	if _, err := b.client(config).GetListByAddress(address); err != nil {
+		op.failed(classifyError(err), err)
+		if mailgun.GetStatusFromErr(err) == http.StatusNotFound {
+			return logical.ErrorResponse(fmt.Sprintf("Mailing list '%s' does not exist in mailgun any longer.", address)), nil
+		}
+		return logical.ErrorResponse(fmt.Sprintf("Unable to look up mailing list in mailgun: %v", err)), nil
+	}
+	return b.renewLease(op, req, config, r)
+}
+
+func (b *mailgunBackend) secretMailingListRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	address, ok := req.Secret.InternalData[internalDataList]
+	if !ok {
+		return nil, fmt.Errorf("no internal list address found")
+	}
+
+	lock := b.inventoryLock(address.(string))
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The list may have been disabled with lookup/<address>/disable already.
+	entry, err := getInventoryEntry(ctx, req.Storage, address.(string))
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && entry.revoked() {
+		return nil, nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	client := b.client(config)
+
+	op := b.startLeaseOperation(operationDelete, req, config, &role{CredentialType: credentialTypeMailingList})
+	// A list deleted in mailgun already is revoked as well.
+	err = client.DeleteList(address.(string))
+	if err != nil && mailgun.GetStatusFromErr(err) != http.StatusNotFound {
+		op.failed(classifyError(err), err)
+		return logical.ErrorResponse(fmt.Sprintf("Unable to delete mailing list in mailgun: %v", err)), nil
+	}
+	if err := markInventoryRevoked(ctx, req.Storage, address.(string), revokedReasonLease); err != nil {
+		op.failed(errorClassStorage, err)
+		return nil, err
+	}
+	op.succeeded()
+
+	return nil, nil
+}
+
+func (b *mailgunBackend) generateMailingList(ctx context.Context, req *logical.Request, config *config, roleName string, r *role, members []string) (*logical.Response, error) {
+	localPart, err := renderListAddress(r.ListAddressTemplate, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	address := fmt.Sprintf("%s@%s", localPart, config.Domain)
+	op := b.startOperation(operationCreate, credentialTypeMailingList, roleName, config.Domain, address)
+	client := b.client(config)
+	list, err := client.CreateList(mailgun.List{
+		Address:     address,
+		Description: r.ListDescription,
+		AccessLevel: r.ListAccessLevel,
+	})
+	if err != nil {
+		op.failed(classifyError(err), err)
+		return logical.ErrorResponse(fmt.Sprintf("Unable to create mailing list in mailgun: %v", err)), nil
+	}
+
+	if len(members) > 0 {
+		newMembers := make([]interface{}, len(members))
+		for i, member := range members {
+			newMembers[i] = member
+		}
+		if err = client.CreateMemberList(nil, list.Address, newMembers); err != nil {
+			op.failed(classifyError(err), err)
+			// Do not leave a half initialized list behind.
+			if deleteErr := client.DeleteList(list.Address); deleteErr != nil {
+				return nil, fmt.Errorf("unable to delete mailing list %s after failing to add members: %v", list.Address, deleteErr)
+			}
+			return logical.ErrorResponse(fmt.Sprintf("Unable to add members to mailing list in mailgun: %v", err)), nil
+		}
+	}
+
+	err = putInventoryEntry(ctx, req.Storage, newInventoryEntry(req, list.Address, credentialTypeMailingList, config.Domain, roleName))
+	if err != nil {
+		op.failed(errorClassStorage, err)
+		// Without a lease nothing would ever delete the list.
+		if deleteErr := client.DeleteList(list.Address); deleteErr != nil {
+			return nil, multierror.Append(err, fmt.Errorf("unable to delete mailing list %s: %v", list.Address, deleteErr))
+		}
+		return nil, err
+	}
+	op.succeeded()
+
+	secretD := map[string]interface{}{
+		"address": list.Address,
+	}
+	internalD := map[string]interface{}{
+		internalDataList: list.Address,
+		internalDataRole: roleName,
+	}
+
+	secret := b.Secret(secretTypeMailingList)
+	resp := secret.Response(secretD, internalD)
+	resp.Secret.TTL, resp.Secret.MaxTTL = r.leaseTTLs(config)
+	resp.Secret.Renewable = true
+	return resp, nil
+}
+
+// renderListAddress replaces the placeholders of the role's address template.
+func renderListAddress(template, roleName string) (string, error) {
+	random, err := base62.Random(5, true)
+	if err != nil {
+		return "", fmt.Errorf("unable to create random list address: %v", err)
+	}
+	replacer := strings.NewReplacer(
+		"{{role}}", roleName,
+		"{{random}}", strings.ToLower(random),
+		"{{unix_time}}", strconv.FormatInt(time.Now().Unix(), 10),
+	)
+	return strings.ToLower(replacer.Replace(template)), nil
+}
@@ -0,0 +1,132 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"strings"
+	"testing"
+)
+
+func TestMailingList(t *testing.T) {
+	t.Run("mailing list role creates list with templated address", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("loadtest", map[string]interface{}{
+			"credential_type":       credentialTypeMailingList,
+			"list_address_template": "lt-{{role}}-{{random}}",
+		}, t, b, storage)
+
+		resp := requestRoleCredentials("loadtest", nil, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Creating mailing list failed:", resp.Error())
+		}
+		address := resp.Data["address"].(string)
+		if !strings.HasPrefix(address, "lt-loadtest-") || !strings.HasSuffix(address, "@example.com") {
+			t.Error("Unexpected list address:", address)
+		}
+		if _, ok := testClient(b).lists[address]; !ok {
+			t.Error("List", address, "was not created in mailgun")
+		}
+	})
+
+	t.Run("mailing list is deleted if it cannot be stored", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("loadtest", map[string]interface{}{
+			"credential_type": credentialTypeMailingList,
+		}, t, b, storage)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   &failingStorage{Storage: storage, prefix: inventoryStoragePrefix},
+			Operation: logical.UpdateOperation,
+			Path:      "credentials/loadtest",
+		})
+
+		if err == nil {
+			t.Error("storage error should be returned")
+		}
+		if lists := testClient(b).lists; len(lists) != 0 {
+			t.Error("mailing list should be deleted in mailgun:", lists)
+		}
+	})
+
+	t.Run("members are added to the mailing list", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("loadtest", map[string]interface{}{
+			"credential_type": credentialTypeMailingList,
+		}, t, b, storage)
+
+		resp := requestRoleCredentials("loadtest", map[string]interface{}{
+			"members": "a@example.org,b@example.org",
+		}, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Creating mailing list failed:", resp.Error())
+		}
+		members := testClient(b).lists[resp.Data["address"].(string)]
+		if len(members) != 2 || members[0] != "a@example.org" || members[1] != "b@example.org" {
+			t.Error("Unexpected members:", members)
+		}
+	})
+
+	t.Run("revoking the lease deletes the mailing list", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("loadtest", map[string]interface{}{
+			"credential_type": credentialTypeMailingList,
+		}, t, b, storage)
+		resp := requestRoleCredentials("loadtest", nil, t, b, storage)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    resp.Secret,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(testClient(b).lists) != 0 {
+			t.Error("Mailing list was not deleted:", testClient(b).lists)
+		}
+	})
+
+	t.Run("revoking a mailing list deleted in mailgun succeeds", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("loadtest", map[string]interface{}{
+			"credential_type": credentialTypeMailingList,
+		}, t, b, storage)
+		resp := requestRoleCredentials("loadtest", nil, t, b, storage)
+		address := resp.Secret.InternalData[internalDataList].(string)
+		delete(testClient(b).lists, address)
+
+		if resp := revokeSecret(resp.Secret, t, b, storage); resp.IsError() {
+			t.Fatal("Revoke failed:", resp.Error())
+		}
+
+		if resp := readInventory(address, t, b, storage); resp.Data["revoked"] != true {
+			t.Error("Inventory entry was not marked revoked:", resp.Data)
+		}
+	})
+}
+
+func requestRoleCredentials(role string, data map[string]interface{}, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "credentials/" + role,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,205 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"time"
+)
+
+const (
+	defaultAbuseWindow = time.Hour
+	// defaultMonitorInterval is how often the events of a monitored
+	// credential are polled by default.
+	defaultMonitorInterval = 5 * time.Minute
+)
+
+// monitorCredentials revokes the SMTP credentials that exceed the abuse
+// thresholds of their roles, and with idle_revoke those exceeding the idle
+// timeout. Failures of single credentials are logged and do not stop the
+// others from being checked.
+//
+// Plugins cannot revoke leases. The credential is deleted in Mailgun and
+// marked revoked in the inventory, its lease is orphaned: it cannot be
+// renewed any longer and stays until it expires or is revoked.
+func (b *mailgunBackend) monitorCredentials(ctx context.Context, s logical.Storage) error {
+	config, err := getConfig(ctx, s)
+	if err != nil || config == nil {
+		return err
+	}
+
+	entries, err := listInventory(ctx, s)
+	if err != nil {
+		return err
+	}
+	roles := map[string]*role{}
+	for _, entry := range entries {
+		if entry.revoked() || entry.CredentialType != credentialTypeSmtp || entry.Role == "" {
+			continue
+		}
+		r, ok := roles[entry.Role]
+		if !ok {
+			if r, err = getRole(ctx, s, entry.Role); err != nil {
+				return err
+			}
+			roles[entry.Role] = r
+		}
+		if r == nil {
+			continue
+		}
+		if err := b.monitorCredential(ctx, s, config, entry.Username, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// monitorCredential checks the credential of username and revokes it if
+// required. The entry is read again under its lock, the webhook or a
+// revocation may have changed it since it was listed.
+func (b *mailgunBackend) monitorCredential(ctx context.Context, s logical.Storage, config *config, username string, r *role) error {
+	lock := b.inventoryLock(username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, err := getInventoryEntry(ctx, s, username)
+	if err != nil || entry == nil || entry.revoked() {
+		return err
+	}
+
+	reason, err := b.monitorReason(ctx, s, config, entry, r)
+	if err != nil || reason == "" {
+		return err
+	}
+
+	resp, err := b.revokeIssuedCredential(ctx, s, config, entry, reason)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		b.Logger().Error("failed to revoke monitored credential", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "reason", reason, "error", resp.Error())
+		return nil
+	}
+	b.Logger().Warn("revoked monitored credential, its lease stays until it expires", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "lease_prefix", entry.LeasePrefix, "reason", reason)
+	return nil
+}
+
+// monitorReason returns why the credential has to be revoked, or an empty
+// string if it may be kept. Only storage errors are returned, the credential
+// is kept if its events cannot be fetched. The events of a credential are
+// polled at most once per monitor_interval of the config.
+func (b *mailgunBackend) monitorReason(ctx context.Context, s logical.Storage, config *config, entry *inventoryEntry, r *role) (string, error) {
+	address := fmt.Sprintf("%s@%s", entry.Username, entry.Domain)
+
+	// With the webhook enabled, Mailgun reports the events and they are not
+	// polled.
+	webhook := config.WebhookSigningKey != ""
+	due := time.Since(entry.LastCheckedAt) >= config.monitorInterval()
+	polled := false
+
+	if r.AbuseMonitor && (webhook || due) {
+		var events []mailgun.Event
+		if webhook {
+			events = entry.reportedEvents(time.Now().Add(-r.abuseWindow()))
+		} else {
+			var err error
+			if events, _, err = b.senderEvents(config, address, r.abuseWindow()); err != nil {
+				b.Logger().Warn("failed to get events of credential", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "error", err)
+				return "", nil
+			}
+			polled = true
+		}
+		if reason := abuseReason(r, events); reason != "" {
+			return reason, nil
+		}
+	}
+
+	// Only credentials that were not known to be used within the timeout
+	// require a look at their events. They are polled in webhook mode as
+	// well, a missed or misconfigured webhook must not revoke credentials
+	// that are in use.
+	if r.IdleTimeout > 0 && time.Since(entry.lastActive()) > r.IdleTimeout {
+		if !due {
+			return "", nil
+		}
+		events, _, err := b.senderEvents(config, address, r.IdleTimeout)
+		if err != nil {
+			b.Logger().Warn("failed to get events of credential", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "error", err)
+			return "", nil
+		}
+		polled = true
+		lastUsed := lastSend(events)
+		switch {
+		case !lastUsed.IsZero():
+			entry.LastUsedAt = lastUsed
+			entry.IdleAt = time.Time{}
+		case r.IdleRevoke:
+			return idleReason(r), nil
+		case entry.IdleAt.IsZero():
+			// Mailgun does not record the SMTP login, a login sending with
+			// another envelope sender looks idle. It is only reported
+			// unless the role revokes idle credentials.
+			entry.IdleAt = time.Now()
+			b.Logger().Warn("credential is idle, it is not revoked without idle_revoke", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "idle_timeout", r.IdleTimeout)
+		}
+	}
+
+	if polled {
+		entry.LastCheckedAt = time.Now()
+		if err := putInventoryEntry(ctx, s, entry); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// abuseReason returns why the events exceed the abuse thresholds of the
+// role, or an empty string if they do not.
+func abuseReason(r *role, events []mailgun.Event) string {
+	sends, bounces, complaints := 0, 0, 0
+	for _, event := range events {
+		switch event.Event {
+		case mailgun.EventAccepted:
+			sends++
+		case mailgun.EventFailed:
+			bounces++
+		case mailgun.EventComplained:
+			complaints++
+		}
+	}
+
+	thresholds := []struct {
+		name         string
+		count, limit int
+	}{
+		{"abuse_max_sends", sends, r.AbuseMaxSends},
+		{"abuse_max_bounces", bounces, r.AbuseMaxBounces},
+		{"abuse_max_complaints", complaints, r.AbuseMaxComplaints},
+	}
+	for _, threshold := range thresholds {
+		if threshold.limit > 0 && threshold.count > threshold.limit {
+			return fmt.Sprintf("abuse: %d events exceed %s of %d within %s", threshold.count, threshold.name, threshold.limit, r.abuseWindow())
+		}
+	}
+	return ""
+}
+
+func idleReason(r *role) string {
+	return fmt.Sprintf("idle: no message sent within idle_timeout of %s", r.IdleTimeout)
+}
+
+// lastSend returns the time of the latest accepted message of the events, or
+// the zero time if there is none.
+func lastSend(events []mailgun.Event) time.Time {
+	var last time.Time
+	for _, event := range events {
+		if event.Event != mailgun.EventAccepted {
+			continue
+		}
+		if timestamp := time.Time(event.Timestamp); timestamp.After(last) {
+			last = timestamp
+		}
+	}
+	return last
+}
@@ -0,0 +1,317 @@
+package mgsecret
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitorCredentials(t *testing.T) {
+	t.Run("credential exceeding a threshold is revoked", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		address := requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string)
+		username := strings.Split(address, "@")[0]
+		testClient(b).events[address] = recentEvents(mailgun.EventAccepted, mailgun.EventFailed, mailgun.EventFailed)
+
+		monitor(t, b, storage)
+
+		if _, ok := testClient(b).credentials[username]; ok {
+			t.Error("credential should be deleted in mailgun")
+		}
+		resp := readInventory(username, t, b, storage)
+		if resp.Data["revoked_at"] == "" {
+			t.Error("credential should be marked as revoked")
+		}
+		if reason := resp.Data["revoked_reason"].(string); !strings.Contains(reason, "abuse_max_bounces") {
+			t.Error("Unexpected revoked_reason:", reason)
+		}
+	})
+
+	t.Run("credential within thresholds is kept", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		address := requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string)
+		username := strings.Split(address, "@")[0]
+		testClient(b).events[address] = recentEvents(mailgun.EventAccepted, mailgun.EventFailed)
+
+		monitor(t, b, storage)
+
+		if _, ok := testClient(b).credentials[username]; !ok {
+			t.Error("credential should not be deleted in mailgun")
+		}
+		if resp := readInventory(username, t, b, storage); resp.Data["revoked_at"] != "" {
+			t.Error("credential should not be marked as revoked")
+		}
+	})
+
+	t.Run("events are attributed by envelope sender", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		abused := requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string)
+		kept := requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string)
+		// The abused login sends with the From address of the other one.
+		events := recentEvents(mailgun.EventFailed, mailgun.EventFailed)
+		for i := range events {
+			events[i].Message = &mailgun.EventMessage{Headers: map[string]string{"from": kept}}
+		}
+		testClient(b).events[abused] = events
+
+		monitor(t, b, storage)
+
+		if resp := readInventory(strings.Split(abused, "@")[0], t, b, storage); resp.Data["revoked_at"] == "" {
+			t.Error("login sending the messages should be revoked")
+		}
+		if resp := readInventory(strings.Split(kept, "@")[0], t, b, storage); resp.Data["revoked_at"] != "" {
+			t.Error("login named in the From header should not be revoked")
+		}
+	})
+
+	t.Run("credentials of roles without monitor are not checked", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		address := requestCredentials(t, b, storage).Data["username"].(string)
+		testClient(b).events[address] = recentEvents(mailgun.EventFailed, mailgun.EventFailed)
+
+		monitor(t, b, storage)
+
+		if requests := testClient(b).eventRequests; requests != 0 {
+			t.Error("events should not be requested but were requested", requests, "times")
+		}
+	})
+
+	t.Run("failing deletion keeps credential active", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		address := requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string)
+		username := strings.Split(address, "@")[0]
+		testClient(b).events[address] = recentEvents(mailgun.EventFailed, mailgun.EventFailed)
+		testClient(b).deleteErrors[username] = errors.New("unavailable")
+
+		monitor(t, b, storage)
+
+		if resp := readInventory(username, t, b, storage); resp.Data["revoked_at"] != "" {
+			t.Error("credential should not be marked as revoked")
+		}
+	})
+
+	t.Run("lease of abused credential is orphaned", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		resp := requestRoleCredentials("monitored", nil, t, b, storage)
+		address := resp.Data["username"].(string)
+		testClient(b).events[address] = recentEvents(mailgun.EventFailed, mailgun.EventFailed)
+		monitor(t, b, storage)
+
+		// The plugin cannot revoke the lease. It cannot be renewed any
+		// longer, and revoking it succeeds.
+		if renew := renewSecret(resp.Secret, t, b, storage); !renew.IsError() {
+			t.Error("Lease of abused credential was renewed")
+		}
+		if revoke := revokeSecret(resp.Secret, t, b, storage); revoke != nil && revoke.IsError() {
+			t.Error("Unexpected error:", revoke.Error())
+		}
+	})
+
+	t.Run("credential is polled once per monitor_interval", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		address := requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string)
+		username := strings.Split(address, "@")[0]
+
+		monitor(t, b, storage)
+		b.activityCache = map[string]*activityCacheEntry{}
+		monitor(t, b, storage)
+
+		if requests := testClient(b).eventRequests; requests != 1 {
+			t.Error("events should be requested once but were requested", requests, "times")
+		}
+		if resp := readInventory(username, t, b, storage); resp.Data["last_checked_at"] == "" {
+			t.Error("last_checked_at should be recorded")
+		}
+	})
+
+	t.Run("failing job does not stop the monitor", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		address := requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string)
+		testClient(b).events[address] = recentEvents(mailgun.EventFailed, mailgun.EventFailed)
+		storeRole("pool", map[string]interface{}{
+			"credential_type": credentialTypeLibrary,
+			"library_size":    1,
+		}, t, b, storage)
+		testClient(b).createError = errors.New("unavailable")
+
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err == nil {
+			t.Error("failing library refill should be returned")
+		}
+
+		if resp := readInventory(strings.Split(address, "@")[0], t, b, storage); resp.Data["revoked_at"] == "" {
+			t.Error("credential should be revoked despite the failing refill")
+		}
+	})
+}
+
+func TestMonitorIdleCredentials(t *testing.T) {
+	t.Run("unused credential is revoked", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		username := requestIdleCredential(t, b, storage)
+		testClient(b).events[username+"@example.com"] = recentEvents(mailgun.EventFailed)
+
+		monitor(t, b, storage)
+
+		resp := readInventory(username, t, b, storage)
+		if resp.Data["revoked_at"] == "" {
+			t.Error("credential should be marked as revoked")
+		}
+		if reason := resp.Data["revoked_reason"].(string); !strings.Contains(reason, "idle_timeout") {
+			t.Error("Unexpected revoked_reason:", reason)
+		}
+	})
+
+	t.Run("unused credential is reported without idle_revoke", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		storeRole("idle", map[string]interface{}{"idle_revoke": false}, t, b, storage)
+		username := requestIdleCredential(t, b, storage)
+
+		monitor(t, b, storage)
+
+		if _, ok := testClient(b).credentials[username]; !ok {
+			t.Error("credential should not be deleted in mailgun")
+		}
+		resp := readInventory(username, t, b, storage)
+		if resp.Data["revoked_at"] != "" {
+			t.Error("credential should not be marked as revoked")
+		}
+		if resp.Data["idle_at"] == "" {
+			t.Error("idle_at should be recorded")
+		}
+	})
+
+	t.Run("used credential is kept", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		username := requestIdleCredential(t, b, storage)
+		testClient(b).events[username+"@example.com"] = recentEvents(mailgun.EventAccepted)
+
+		monitor(t, b, storage)
+		monitor(t, b, storage)
+
+		resp := readInventory(username, t, b, storage)
+		if resp.Data["revoked_at"] != "" {
+			t.Error("credential should not be marked as revoked")
+		}
+		if resp.Data["last_used_at"] == "" {
+			t.Error("last_used_at should be recorded")
+		}
+		if requests := testClient(b).eventRequests; requests != 1 {
+			t.Error("events should be requested once but were requested", requests, "times")
+		}
+	})
+
+	t.Run("new credential is not checked", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testMonitorBackend(t)
+		requestRoleCredentials("idle", nil, t, b, storage)
+
+		monitor(t, b, storage)
+
+		if requests := testClient(b).eventRequests; requests != 0 {
+			t.Error("events should not be requested but were requested", requests, "times")
+		}
+	})
+}
+
+func TestMonitorRoleValidation(t *testing.T) {
+	t.Run("monitor without threshold fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		resp := storeRole("monitored", map[string]interface{}{"abuse_monitor": true}, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("monitor without thresholds should fail")
+		}
+	})
+
+	t.Run("idle timeout of mailing lists fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		resp := storeRole("lists", map[string]interface{}{"credential_type": credentialTypeMailingList, "idle_timeout": "1h"}, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("idle timeout of mailing lists should fail")
+		}
+	})
+
+	t.Run("idle revoke without idle timeout fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		resp := storeRole("idle", map[string]interface{}{"idle_revoke": true}, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("idle revoke without idle timeout should fail")
+		}
+	})
+
+	t.Run("negative threshold fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		resp := storeRole("monitored", map[string]interface{}{"abuse_monitor": true, "abuse_max_sends": -1}, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("negative threshold should fail")
+		}
+	})
+}
+
+func testMonitorBackend(t *testing.T) (*mailgunBackend, logical.Storage) {
+	b, storage := testBackend(t)
+	storeDefaultConfig(t, b, storage)
+	storeRole("monitored", map[string]interface{}{
+		"abuse_monitor":     true,
+		"abuse_window":      "1h",
+		"abuse_max_bounces": 1,
+	}, t, b, storage)
+	storeRole("idle", map[string]interface{}{"idle_timeout": "1h", "idle_revoke": true}, t, b, storage)
+	return b, storage
+}
+
+// requestIdleCredential issues a credential of the idle role that was created
+// before its idle timeout.
+func requestIdleCredential(t *testing.T, b *mailgunBackend, storage logical.Storage) string {
+	address := requestRoleCredentials("idle", nil, t, b, storage).Data["username"].(string)
+	username := strings.Split(address, "@")[0]
+	entry, err := getInventoryEntry(context.Background(), storage, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.CreatedAt = entry.CreatedAt.Add(-2 * time.Hour)
+	if err := putInventoryEntry(context.Background(), storage, entry); err != nil {
+		t.Fatal(err)
+	}
+	return username
+}
+
+func monitor(t *testing.T, b *mailgunBackend, storage logical.Storage) {
+	if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recentEvents(types ...mailgun.EventType) []mailgun.Event {
+	events := make([]mailgun.Event, 0, len(types))
+	for _, eventType := range types {
+		events = append(events, mailgun.Event{Event: eventType, Timestamp: mailgun.TimestampNano(time.Now().Add(-time.Minute))})
+	}
+	return events
+}
@@ -0,0 +1,103 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	t.Run("every operation documents its responses", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		doc := openAPIDocument(t, b, storage)
+
+		if len(doc.Paths) != len(b.Paths) {
+			t.Error("expected", len(b.Paths), "documented paths but got", len(doc.Paths))
+		}
+		for path, item := range doc.Paths {
+			for method, op := range map[string]*framework.OASOperation{"get": item.Get, "post": item.Post, "delete": item.Delete} {
+				if op == nil {
+					continue
+				}
+				if _, ok := op.Responses[http.StatusInternalServerError]; !ok {
+					t.Error(method, path, "does not document its responses")
+				}
+				for code, resp := range op.Responses {
+					if resp.Description == "" {
+						t.Error(method, path, "has no description of response", code)
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("every field is described", func(t *testing.T) {
+		t.Parallel()
+		b, _ := testBackend(t)
+
+		for _, path := range b.Paths {
+			for name, field := range path.Fields {
+				if field.Description == "" {
+					t.Error("field", name, "of", path.Pattern, "has no description")
+				}
+			}
+		}
+		for _, secret := range b.Secrets {
+			if len(secret.Fields) == 0 {
+				t.Error("secret", secret.Type, "has no fields")
+			}
+			for name, field := range secret.Fields {
+				if field.Description == "" {
+					t.Error("field", name, "of secret", secret.Type, "has no description")
+				}
+			}
+		}
+	})
+
+	t.Run("credentials document the secret", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		doc := openAPIDocument(t, b, storage)
+
+		resp := doc.Paths["/credentials"].Get.Responses[http.StatusOK]
+		if resp == nil || resp.Content["application/json"] == nil {
+			t.Fatal("credentials have no example response")
+		}
+		for name := range smtpCredentialFields() {
+			if name == outputFormatSmtpUri || name == outputFormatPostfixSaslPasswd {
+				continue
+			}
+			if _, ok := smtpCredentialExample[name]; !ok {
+				t.Error("example response of credentials is missing", name)
+			}
+		}
+	})
+
+	t.Run("webhook is documented as unauthenticated", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		doc := openAPIDocument(t, b, storage)
+
+		webhook := doc.Paths["/webhook"]
+		if webhook == nil || !webhook.Unauthenticated {
+			t.Error("webhook should be documented as unauthenticated")
+		}
+		if _, ok := webhook.Post.Responses[http.StatusForbidden]; !ok {
+			t.Error("webhook should document rejected requests")
+		}
+	})
+}
+
+func openAPIDocument(t *testing.T, b *mailgunBackend, storage logical.Storage) *framework.OASDocument {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.HelpOperation,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Data["openapi"].(*framework.OASDocument)
+}
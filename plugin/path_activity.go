@@ -0,0 +1,241 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultActivityWindow = 24 * time.Hour
+	// activityCacheTTL is how long the events of a credential are cached.
+	activityCacheTTL = time.Minute
+	// maxActivityEvents limits the events requested per credential.
+	maxActivityEvents = 1000
+	// recentActivityEvents is the number of sends and failures returned.
+	recentActivityEvents = 20
+)
+
+func pathActivity(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "creds-activity/(?P<name>.+)$",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "SMTP username, with or without domain, or lease ID or lease prefix of the credential.",
+			},
+			"window": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How far back to look for events.",
+				Default:     int(defaultActivityWindow / time.Second),
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathActivityRead,
+				Summary:  "Return the sending activity of a credential.",
+				Responses: operationResponses(http.StatusOK, "The number of sent and failed messages within the window and the latest events.", map[string]interface{}{
+					"username":        "vault.k3x9a@example.com",
+					"role":            "ci",
+					"window":          int(defaultActivityWindow / time.Second),
+					"sends":           1,
+					"failures":        0,
+					"last_used":       "2019-01-02T15:04:05Z",
+					"recent_sends":    []map[string]interface{}{{"timestamp": "2019-01-02T15:04:05Z", "event": "accepted"}},
+					"recent_failures": []map[string]interface{}{},
+					"fetched_at":      "2019-01-02T15:05:00Z",
+					"truncated":       false,
+				}, http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathActivityHelpSyn,
+		HelpDescription: pathActivityHelpDesc,
+	}
+}
+
+// leaseInventoryEntry returns the entry of the only SMTP or library credential
+// not revoked yet that was issued on the lease prefix of lease, a lease ID or
+// a lease prefix. Vault does not pass lease IDs to plugins, leases can only be
+// told apart by their prefix. An error response is returned if the prefix
+// matches none or several credentials.
+func leaseInventoryEntry(ctx context.Context, s logical.Storage, lease string) (*inventoryEntry, *logical.Response, error) {
+	lease = strings.TrimSuffix(lease, "/")
+	entries, err := listInventory(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var matches []*inventoryEntry
+	var usernames []string
+	for _, entry := range entries {
+		if entry.revoked() || entry.CredentialType == credentialTypeMailingList || entry.LeasePrefix == "" {
+			continue
+		}
+		leaseID := strings.TrimPrefix(lease, entry.LeasePrefix+"/")
+		if lease == entry.LeasePrefix || (leaseID != lease && !strings.Contains(leaseID, "/")) {
+			matches = append(matches, entry)
+			usernames = append(usernames, fmt.Sprintf("%s@%s", entry.Username, entry.Domain))
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, logical.ErrorResponse(fmt.Sprintf("No SMTP credential issued by this mount is leased on '%s'.", lease)), nil
+	case 1:
+		return matches[0], nil, nil
+	}
+	sort.Strings(usernames)
+	return nil, logical.ErrorResponse(fmt.Sprintf("%d SMTP credentials are leased on the prefix of '%s': %s. Vault does not pass lease IDs to plugins, use the username instead.",
+		len(matches), lease, strings.Join(usernames, ", "))), nil
+}
+
+// activityCacheEntry holds the events of a credential requested from Mailgun.
+type activityCacheEntry struct {
+	events    []mailgun.Event
+	fetchedAt time.Time
+}
+
+func (b *mailgunBackend) pathActivityRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	window := time.Duration(data.Get("window").(int)) * time.Second
+	if window <= 0 {
+		return logical.ErrorResponse("'window' must be positive."), nil
+	}
+
+	var entry *inventoryEntry
+	var err error
+	if strings.Contains(name, "/") {
+		var resp *logical.Response
+		if entry, resp, err = leaseInventoryEntry(ctx, req.Storage, name); resp != nil || err != nil {
+			return resp, err
+		}
+	} else if entry, err = lookupInventoryEntry(ctx, req.Storage, name); err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.CredentialType == credentialTypeMailingList {
+		return logical.ErrorResponse(fmt.Sprintf("'%s' is not an SMTP credential issued by this mount.", name)), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	address := fmt.Sprintf("%s@%s", entry.Username, entry.Domain)
+	events, fetchedAt, err := b.senderEvents(config, address, window)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to get events from mailgun: %v", err)), nil
+	}
+
+	sends, failures := 0, 0
+	recentSends := []map[string]interface{}{}
+	recentFailures := []map[string]interface{}{}
+	var lastUsed time.Time
+	for _, event := range events {
+		switch event.Event {
+		case mailgun.EventAccepted:
+			sends++
+			if len(recentSends) < recentActivityEvents {
+				recentSends = append(recentSends, activityEventData(event))
+			}
+			if timestamp := time.Time(event.Timestamp); timestamp.After(lastUsed) {
+				lastUsed = timestamp
+			}
+		case mailgun.EventFailed, mailgun.EventRejected:
+			failures++
+			if len(recentFailures) < recentActivityEvents {
+				recentFailures = append(recentFailures, activityEventData(event))
+			}
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"username":        address,
+			"role":            entry.Role,
+			"window":          int64(window / time.Second),
+			"sends":           sends,
+			"failures":        failures,
+			"last_used":       formatTime(lastUsed),
+			"recent_sends":    recentSends,
+			"recent_failures": recentFailures,
+			"fetched_at":      formatTime(fetchedAt),
+			"truncated":       len(events) >= maxActivityEvents,
+		},
+	}, nil
+}
+
+// senderEvents returns the events of messages sent from address within the
+// window. The events are cached for activityCacheTTL. The lock is not held
+// while the events are requested, so a slow request does not block the
+// lookups of other credentials.
+func (b *mailgunBackend) senderEvents(config *config, address string, window time.Duration) ([]mailgun.Event, time.Time, error) {
+	key := fmt.Sprintf("%s/%d", strings.ToLower(address), window)
+
+	b.activityLock.Lock()
+	if cached, ok := b.activityCache[key]; ok && time.Since(cached.fetchedAt) < activityCacheTTL {
+		b.activityLock.Unlock()
+		return cached.events, cached.fetchedAt, nil
+	}
+	// Drop expired entries, so the cache does not grow with every credential.
+	for cachedKey, cached := range b.activityCache {
+		if time.Since(cached.fetchedAt) >= activityCacheTTL {
+			delete(b.activityCache, cachedKey)
+		}
+	}
+	b.activityLock.Unlock()
+
+	events, err := b.client(config).ListSenderEvents(address, time.Now().Add(-window), maxActivityEvents)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cached := &activityCacheEntry{events: events, fetchedAt: time.Now()}
+	b.activityLock.Lock()
+	b.activityCache[key] = cached
+	b.activityLock.Unlock()
+	return cached.events, cached.fetchedAt, nil
+}
+
+func activityEventData(event mailgun.Event) map[string]interface{} {
+	eventData := map[string]interface{}{
+		"timestamp": formatTime(time.Time(event.Timestamp)),
+		"event":     event.Event.String(),
+	}
+	if event.Envelope != nil && event.Envelope.Targets != nil {
+		eventData["recipient"] = *event.Envelope.Targets
+	}
+	if event.Severity != nil {
+		eventData["severity"] = event.Severity.String()
+	}
+	if event.DeliveryStatus != nil && event.DeliveryStatus.Message != nil {
+		eventData["delivery_status"] = *event.DeliveryStatus.Message
+	}
+	return eventData
+}
+
+const pathActivityHelpSyn = `
+Return the sending activity of an SMTP credential.
+`
+
+const pathActivityHelpDesc = `
+Queries the Mailgun events of messages sent from the address of an SMTP
+credential issued by this mount within "window" (default 24h). Returns the
+number of sends and failures, the time the credential was last used and the
+most recent sends and failures. Library logins are included, mailing lists
+are not.
+
+The credential is given by its username or by its lease ID or lease prefix.
+Vault does not pass lease IDs to plugins, so a lease is resolved by its
+prefix. This fails if several credentials not revoked yet were issued on the
+same path, use the username then.
+
+Mailgun does not record the SMTP login in its events, messages are matched by
+their envelope sender, not by their From header. Results are cached for a
+minute.
+`
@@ -0,0 +1,193 @@
+package mgsecret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathActivity(t *testing.T) {
+	t.Run("sends and failures are counted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		address := requestCredentials(t, b, storage).Data["username"].(string)
+		lastUsed := time.Now().Add(-time.Minute).Truncate(time.Second)
+		testClient(b).events[address] = []mailgun.Event{
+			{Event: mailgun.EventAccepted, Timestamp: mailgun.TimestampNano(lastUsed)},
+			{Event: mailgun.EventAccepted, Timestamp: mailgun.TimestampNano(lastUsed.Add(-time.Hour))},
+			{Event: mailgun.EventFailed, Timestamp: mailgun.TimestampNano(lastUsed.Add(-time.Hour))},
+			{Event: mailgun.EventAccepted, Timestamp: mailgun.TimestampNano(lastUsed.Add(-48 * time.Hour))},
+		}
+
+		resp := requestActivity(address, nil, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Unexpected error:", resp.Error())
+		}
+		if resp.Data["sends"] != 2 || resp.Data["failures"] != 1 {
+			t.Error("expected 2 sends and 1 failure but got", resp.Data["sends"], resp.Data["failures"])
+		}
+		if resp.Data["last_used"] != lastUsed.Format(time.RFC3339) {
+			t.Error("last_used should be", lastUsed.Format(time.RFC3339), "but is", resp.Data["last_used"])
+		}
+		if recent := resp.Data["recent_failures"].([]map[string]interface{}); len(recent) != 1 || recent[0]["event"] != "failed" {
+			t.Error("Unexpected recent_failures:", recent)
+		}
+	})
+
+	t.Run("events are cached", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		address := requestCredentials(t, b, storage).Data["username"].(string)
+
+		requestActivity(address, nil, t, b, storage)
+		requestActivity(address, nil, t, b, storage)
+		requestActivity(address, map[string]interface{}{"window": "1h"}, t, b, storage)
+
+		if requests := testClient(b).eventRequests; requests != 2 {
+			t.Error("events should be requested twice but were requested", requests, "times")
+		}
+	})
+
+	t.Run("unknown credential fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		if resp := requestActivity("postmaster@example.com", nil, t, b, storage); !resp.IsError() {
+			t.Error("activity of unknown credential should fail")
+		}
+	})
+
+	t.Run("credential is found by lease", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		address := requestCredentials(t, b, storage).Data["username"].(string)
+		testClient(b).events[address] = []mailgun.Event{
+			{Event: mailgun.EventAccepted, Timestamp: mailgun.TimestampNano(time.Now())},
+		}
+
+		for _, lease := range []string{"credentials/0a1b2c3d", "credentials/"} {
+			resp := requestActivity(lease, nil, t, b, storage)
+
+			if resp.IsError() {
+				t.Fatal("Unexpected error:", resp.Error())
+			}
+			if resp.Data["sends"] != 1 {
+				t.Error("expected 1 send for", lease, "but got", resp.Data["sends"])
+			}
+		}
+	})
+
+	t.Run("lease shared by several credentials fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		requestCredentials(t, b, storage)
+		requestCredentials(t, b, storage)
+
+		resp := requestActivity("credentials/0a1b2c3d", nil, t, b, storage)
+
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), "use the username") {
+			t.Error("ambiguous lease should fail but got", resp)
+		}
+	})
+
+	t.Run("unknown lease fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		requestCredentials(t, b, storage)
+
+		if resp := requestActivity("roles/0a1b2c3d", nil, t, b, storage); !resp.IsError() {
+			t.Error("activity of unknown lease should fail")
+		}
+	})
+
+	t.Run("library logins are included", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		address := libraryRequest("check-out", nil, t, b, storage).Data["username"].(string)
+		testClient(b).events[address] = []mailgun.Event{
+			{Event: mailgun.EventAccepted, Timestamp: mailgun.TimestampNano(time.Now())},
+		}
+
+		resp := requestActivity(address, nil, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Unexpected error:", resp.Error())
+		}
+		if resp.Data["sends"] != 1 {
+			t.Error("expected 1 send but got", resp.Data["sends"])
+		}
+	})
+
+	t.Run("events are requested page by page", func(t *testing.T) {
+		t.Parallel()
+		login, other := "vault.abcde@example.com", "billing@example.com"
+		pages := 0
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pages++
+			if from := r.URL.Query().Get("from"); from != "" {
+				t.Error("events must not be filtered by the From header:", r.URL.RawQuery)
+			}
+			var items []mailgun.Event
+			if pages < 3 {
+				items = []mailgun.Event{
+					{
+						Event:     mailgun.EventAccepted,
+						Timestamp: mailgun.TimestampNano(time.Now()),
+						Envelope:  &mailgun.Envelope{Sender: &login},
+						Message:   &mailgun.EventMessage{Headers: map[string]string{"from": other}},
+					},
+					{
+						Event:     mailgun.EventAccepted,
+						Timestamp: mailgun.TimestampNano(time.Now()),
+						Envelope:  &mailgun.Envelope{Sender: &other},
+						Message:   &mailgun.EventMessage{Headers: map[string]string{"from": login}},
+					},
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"items":  items,
+				"paging": map[string]string{"next": fmt.Sprintf("%s/example.com/events/page%d", server.URL, pages)},
+			})
+		}))
+		defer server.Close()
+		client := DefaultMailgunClientFactory("example.com", "key")
+		client.(apiBaseSetter).SetAPIBase(server.URL)
+
+		events, err := client.ListSenderEvents(login, time.Now().Add(-time.Hour), maxActivityEvents)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || pages != 3 {
+			t.Error("expected 2 events from 3 pages but got", len(events), "events from", pages, "pages")
+		}
+	})
+}
+
+func requestActivity(name string, data map[string]interface{}, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "creds-activity/" + name,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
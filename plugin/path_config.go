@@ -3,8 +3,11 @@ package mgsecret
 import (
 	"context"
 	"fmt"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"net"
+	"net/http"
 	"time"
 )
 
@@ -14,13 +17,15 @@ func pathConfig(b *mailgunBackend) *framework.Path {
 		Fields: map[string]*framework.FieldSchema{
 			"api_key": {
 				Type:        framework.TypeString,
-				Description: `Required. Mailgun API Key`,
-				Required:    true,
+				Description: `Mailgun API Key. Required on the first write`,
+			},
+			"secondary_api_key": {
+				Type:        framework.TypeString,
+				Description: "Mailgun API Key that is used if the primary API Key is rejected. An empty value removes it",
 			},
 			"domain": {
 				Type:        framework.TypeString,
-				Description: "Required. Domain to generate SMTP credentials for",
-				Required:    true,
+				Description: "Domain to generate SMTP credentials for. Required on the first write",
 			},
 			"ttl": {
 				Type:        framework.TypeDurationSecond,
@@ -30,16 +35,116 @@ func pathConfig(b *mailgunBackend) *framework.Path {
 				Type:        framework.TypeDurationSecond,
 				Description: "The maximum Time to live (TTL) of the generated credentials",
 			},
+			"region": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("Mailgun region of the account. One of %v", regions),
+				Default:     regionUS,
+			},
+			"smtp_host": {
+				Type:        framework.TypeString,
+				Description: "SMTP host returned with and used to verify generated credentials. Defaults to the SMTP host of the region",
+			},
+			"smtp_port": {
+				Type:        framework.TypeInt,
+				Description: "SMTP port returned with and used to verify generated credentials",
+				Default:     defaultSmtpPort,
+			},
+			"history_size": {
+				Type:        framework.TypeInt,
+				Description: "Number of previous config versions to keep for rollback",
+				Default:     defaultConfigHistorySize,
+			},
+			"validate_only": {
+				Type:        framework.TypeBool,
+				Description: "Only validate the config against the Mailgun API without storing it",
+			},
+			"verbose_logging": {
+				Type:        framework.TypeBool,
+				Description: "Log every request to the plugin and to the Mailgun API",
+			},
+			"webhook_signing_key": {
+				Type:        framework.TypeString,
+				Description: "Mailgun HTTP webhook signing key. Enables the webhook endpoint, an empty value disables it",
+			},
+			"monitor_interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often the events of a credential are polled by the abuse monitor and the idle timeout of roles. Defaults to 5m",
+			},
+			"inventory_retention": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long revoked credentials are kept in the inventory. Defaults to 30 days",
+			},
+			"statsd_address": {
+				Type:        framework.TypeString,
+				Description: "Address (host:port) of a statsd server the metrics of the plugin are sent to. An empty value disables it",
+			},
+			"statsite_address": {
+				Type:        framework.TypeString,
+				Description: "Address (host:port) of a statsite server the metrics of the plugin are sent to. An empty value disables it",
+			},
+			"revoke_outstanding": {
+				Type:        framework.TypeBool,
+				Description: "On delete, delete all SMTP logins issued by this mount in Mailgun first",
+			},
 		},
 
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
 				Callback: b.pathConfigRead,
 				Summary:  "Return the current Mailgun configuration.",
+				Responses: operationResponses(http.StatusOK, "The configuration. The API keys are never returned.", map[string]interface{}{
+					"domain":                        "example.com",
+					"ttl":                           0,
+					"max_ttl":                       0,
+					"region":                        regionUS,
+					"smtp_host":                     defaultSmtpHost,
+					"smtp_port":                     defaultSmtpPort,
+					"version":                       3,
+					"api_key_fingerprint":           "a1b2:hmac-sha256:...",
+					"api_key_set_at":                "2019-01-02T15:04:05Z",
+					"history_size":                  defaultConfigHistorySize,
+					"verbose_logging":               false,
+					"webhook_enabled":               false,
+					"monitor_interval":              int(defaultMonitorInterval / time.Second),
+					"inventory_retention":           int(defaultInventoryRetention / time.Second),
+					"statsd_address":                "",
+					"statsite_address":              "",
+					"secondary_api_key_fingerprint": "",
+				}, http.StatusNotFound),
 			},
 			logical.UpdateOperation: &framework.PathOperation{
 				Callback: b.pathConfigWrite,
 				Summary:  "Configure the Mailgun settings.",
+				Responses: map[int][]framework.Response{
+					http.StatusNoContent: {{Description: "The configuration is stored."}},
+					http.StatusOK: {{
+						Description: "The configuration is valid, returned with validate_only instead of storing it.",
+						Example: &logical.Response{Data: map[string]interface{}{
+							"domain":    "example.com",
+							"region":    regionUS,
+							"smtp_host": defaultSmtpHost,
+							"smtp_port": defaultSmtpPort,
+							"valid":     true,
+						}},
+					}},
+					http.StatusBadRequest:          {errorResponses[http.StatusBadRequest]},
+					http.StatusInternalServerError: {errorResponses[http.StatusInternalServerError]},
+				},
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathConfigDelete,
+				Summary:  "Delete the Mailgun configuration.",
+				Responses: map[int][]framework.Response{
+					http.StatusNoContent: {{Description: "The configuration is deleted."}},
+					http.StatusOK: {{
+						Description: "The configuration is deleted, returned with revoke_outstanding with the deleted and failed SMTP logins.",
+						Example: &logical.Response{Data: map[string]interface{}{
+							"revoked": []string{"vault.k3x9a@example.com"},
+							"failed":  map[string]string{"vault.1yrqc@example.com": "mailgun unavailable"},
+						}},
+					}},
+					http.StatusInternalServerError: {errorResponses[http.StatusInternalServerError]},
+				},
 			},
 		},
 
@@ -56,36 +161,69 @@ func (b *mailgunBackend) pathConfigRead(ctx context.Context, req *logical.Reques
 	if cfg == nil {
 		return nil, nil
 	}
+	// Configs written before fingerprints were introduced.
+	if cfg.ApiKeyFingerprint == "" {
+		if cfg.ApiKeyFingerprint, err = b.apiKeyFingerprint(ctx, req.Storage, cfg.ApiKey); err != nil {
+			return nil, err
+		}
+	}
 
 	return &logical.Response{
-		Data: map[string]interface{}{
-			"domain":  cfg.Domain,
-			"ttl":     int64(cfg.TTL / time.Second),
-			"max_ttl": int64(cfg.MaxTTL / time.Second),
-		},
+		Data: configResponseData(cfg),
 	}, nil
 }
 
+// configResponseData returns the readable fields of the config. The API key
+// is never returned.
+func configResponseData(cfg *config) map[string]interface{} {
+	return map[string]interface{}{
+		"domain":              cfg.Domain,
+		"ttl":                 int64(cfg.TTL / time.Second),
+		"max_ttl":             int64(cfg.MaxTTL / time.Second),
+		"region":              cfg.region(),
+		"smtp_host":           cfg.smtpHost(),
+		"smtp_port":           cfg.smtpPort(),
+		"version":             cfg.Version,
+		"api_key_fingerprint": cfg.ApiKeyFingerprint,
+		"api_key_set_at":      formatTime(cfg.ApiKeySetAt),
+		"history_size":        cfg.historySize(),
+		"verbose_logging":     cfg.VerboseLogging,
+		"webhook_enabled":     cfg.WebhookSigningKey != "",
+		"monitor_interval":    int64(cfg.monitorInterval() / time.Second),
+		"inventory_retention": int64(cfg.inventoryRetention() / time.Second),
+		"statsd_address":      cfg.StatsdAddress,
+		"statsite_address":    cfg.StatsiteAddress,
+
+		"secondary_api_key_fingerprint": cfg.SecondaryApiKeyFingerprint,
+	}
+}
+
 func (b *mailgunBackend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	cfg, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
-	if cfg == nil {
+	created := cfg == nil
+	if created {
 		cfg = &config{}
 	}
+	previous := *cfg
+
+	if apiKeyRaw, ok := data.GetOk("api_key"); ok {
+		cfg.ApiKey = apiKeyRaw.(string)
+	} else if created {
+		return logical.ErrorResponse("Required field 'api_key' is not set."), nil
+	}
 
-	apiKey, resp := getFieldString("api_key", data)
-	if resp != nil {
-		return resp, nil
+	if secondaryApiKeyRaw, ok := data.GetOk("secondary_api_key"); ok {
+		cfg.SecondaryApiKey = secondaryApiKeyRaw.(string)
 	}
-	cfg.ApiKey = apiKey
 
-	domain, resp := getFieldString("domain", data)
-	if resp != nil {
-		return resp, nil
+	if domainRaw, ok := data.GetOk("domain"); ok {
+		cfg.Domain = domainRaw.(string)
+	} else if created {
+		return logical.ErrorResponse("Required field 'domain' is not set."), nil
 	}
-	cfg.Domain = domain
 
 	// Update token TTL.
 	if ttlRaw, ok := data.GetOk("ttl"); ok {
@@ -97,31 +235,281 @@ func (b *mailgunBackend) pathConfigWrite(ctx context.Context, req *logical.Reque
 		cfg.MaxTTL = time.Duration(maxTtlRaw.(int)) * time.Second
 	}
 
-	client := b.MailgunFactory(domain, apiKey)
-	if !client.IsApiKeyValid() {
-		return logical.ErrorResponse("'api_key' is not valid."), nil
+	if cfg.MaxTTL > 0 && cfg.TTL > cfg.MaxTTL {
+		return logical.ErrorResponse("'ttl' must not be greater than 'max_ttl'."), nil
 	}
-	if !client.IsDomainValid() {
-		return logical.ErrorResponse("'domain' is not valid."), nil
+
+	if regionRaw, ok := data.GetOk("region"); ok {
+		cfg.Region = regionRaw.(string)
+	}
+	if !strutil.StrListContains(regions, cfg.region()) {
+		return logical.ErrorResponse(fmt.Sprintf("'region' must be one of %v.", regions)), nil
 	}
 
-	entry, err := logical.StorageEntryJSON("config", cfg)
+	if smtpHostRaw, ok := data.GetOk("smtp_host"); ok {
+		cfg.SmtpHost = smtpHostRaw.(string)
+	}
+
+	if smtpPortRaw, ok := data.GetOk("smtp_port"); ok {
+		cfg.SmtpPort = smtpPortRaw.(int)
+	}
+
+	if historySizeRaw, ok := data.GetOk("history_size"); ok {
+		cfg.HistorySize = historySizeRaw.(int)
+	}
+	if verboseLoggingRaw, ok := data.GetOk("verbose_logging"); ok {
+		cfg.VerboseLogging = verboseLoggingRaw.(bool)
+	}
+	if webhookSigningKeyRaw, ok := data.GetOk("webhook_signing_key"); ok {
+		cfg.WebhookSigningKey = webhookSigningKeyRaw.(string)
+	}
+	if monitorIntervalRaw, ok := data.GetOk("monitor_interval"); ok {
+		cfg.MonitorInterval = time.Duration(monitorIntervalRaw.(int)) * time.Second
+	}
+	if inventoryRetentionRaw, ok := data.GetOk("inventory_retention"); ok {
+		cfg.InventoryRetention = time.Duration(inventoryRetentionRaw.(int)) * time.Second
+	}
+
+	if statsdAddressRaw, ok := data.GetOk("statsd_address"); ok {
+		cfg.StatsdAddress = statsdAddressRaw.(string)
+	}
+	if statsiteAddressRaw, ok := data.GetOk("statsite_address"); ok {
+		cfg.StatsiteAddress = statsiteAddressRaw.(string)
+	}
+
+	if cfg.HistorySize < 0 {
+		return logical.ErrorResponse("'history_size' must not be negative."), nil
+	}
+	if cfg.MonitorInterval < 0 {
+		return logical.ErrorResponse("'monitor_interval' must not be negative."), nil
+	}
+	if cfg.InventoryRetention < 0 {
+		return logical.ErrorResponse("'inventory_retention' must not be negative."), nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.StatsdAddress); cfg.StatsdAddress != "" && err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("'statsd_address' must be host:port: %v", err)), nil
+	}
+	if _, _, err := net.SplitHostPort(cfg.StatsiteAddress); cfg.StatsiteAddress != "" && err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("'statsite_address' must be host:port: %v", err)), nil
+	}
+
+	if data.Get("validate_only").(bool) {
+		if resp := b.validateConfig(cfg); resp != nil {
+			return resp, nil
+		}
+		respData := configResponseData(cfg)
+		respData["valid"] = true
+		// These describe the stored config only.
+		delete(respData, "version")
+		delete(respData, "api_key_fingerprint")
+		delete(respData, "api_key_set_at")
+		delete(respData, "secondary_api_key_fingerprint")
+		return &logical.Response{Data: respData}, nil
+	}
+
+	// The Mailgun API is only asked again if the settings it checks changed.
+	if created || cfg.ApiKey != previous.ApiKey || cfg.SecondaryApiKey != previous.SecondaryApiKey ||
+		cfg.Domain != previous.Domain || cfg.region() != previous.region() {
+		if resp := b.validateConfig(cfg); resp != nil {
+			return resp, nil
+		}
+	}
+
+	return nil, b.putConfig(ctx, req, cfg, 0)
+}
+
+func (b *mailgunBackend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
+	if cfg == nil {
+		return nil, nil
+	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	var resp *logical.Response
+	if data.Get("revoke_outstanding").(bool) {
+		revoked, failed, err := b.revokeOutstanding(ctx, req.Storage, cfg)
+		if err != nil {
+			return nil, err
+		}
+		resp = &logical.Response{
+			Data: map[string]interface{}{
+				"revoked": revoked,
+				"failed":  failed,
+			},
+		}
+		b.Logger().Info("revoked outstanding SMTP logins", "domain", cfg.Domain, "revoked", len(revoked), "failed", len(failed))
+		if len(failed) > 0 {
+			resp.AddWarning(fmt.Sprintf("%d SMTP logins could not be deleted in Mailgun and have to be removed manually.", len(failed)))
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, "config"); err != nil {
 		return nil, err
 	}
+	// The history contains the API key as well.
+	if err := deleteConfigHistory(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("deleted config", "domain", cfg.Domain)
+	return resp, nil
+}
+
+// revokeOutstanding deletes all SMTP logins issued by this mount, including
+// the logins of the library pools. It returns the deleted logins and the
+// error for each login that could not be deleted.
+func (b *mailgunBackend) revokeOutstanding(ctx context.Context, s logical.Storage, cfg *config) ([]string, map[string]string, error) {
+	revoked := []string{}
+	failed := map[string]string{}
+	client := b.client(cfg)
 
-	return nil, nil
+	entries, err := listInventory(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if entry.revoked() || entry.CredentialType != credentialTypeSmtp {
+			continue
+		}
+		address := fmt.Sprintf("%s@%s", entry.Username, entry.Domain)
+		if err := client.DeleteCredential(entry.Username); err != nil {
+			b.Logger().Error("failed to revoke SMTP login", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "error", err)
+			failed[address] = err.Error()
+			continue
+		}
+		lock := b.inventoryLock(entry.Username)
+		lock.Lock()
+		err := markInventoryRevoked(ctx, s, entry.Username, revokedReasonConfigDeleted)
+		lock.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		revoked = append(revoked, address)
+	}
+
+	roleNames, err := s.List(ctx, rolesStoragePrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	b.libraryLock.Lock()
+	defer b.libraryLock.Unlock()
+	for _, roleName := range roleNames {
+		libraryEntries, err := listLibrary(ctx, s, roleName)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range libraryEntries {
+			address := fmt.Sprintf("%s@%s", entry.Login, cfg.Domain)
+			if err := client.DeleteCredential(entry.Login); err != nil {
+				b.Logger().Error("failed to revoke SMTP login of library", "role", roleName, "domain", cfg.Domain, "username", entry.Login, "error", err)
+				failed[address] = err.Error()
+				continue
+			}
+			if err := s.Delete(ctx, libraryEntryKey(roleName, entry.Login)); err != nil {
+				return nil, nil, err
+			}
+			if entry.CheckedOut {
+				if err := markInventoryRevoked(ctx, s, entry.Login, revokedReasonConfigDeleted); err != nil {
+					return nil, nil, err
+				}
+			}
+			revoked = append(revoked, address)
+		}
+	}
+
+	return revoked, failed, nil
+}
+
+// validateConfig checks the API keys and domain against the Mailgun API. It
+// returns an error response if one of them is not valid.
+func (b *mailgunBackend) validateConfig(cfg *config) *logical.Response {
+	// Each key is checked on its own, without falling back to the other.
+	client := b.clientForApiKey(cfg, cfg.ApiKey)
+	if !client.IsApiKeyValid() {
+		return logical.ErrorResponse("'api_key' is not valid.")
+	}
+	if !client.IsDomainValid() {
+		return logical.ErrorResponse("'domain' is not valid.")
+	}
+	if cfg.SecondaryApiKey != "" && !b.clientForApiKey(cfg, cfg.SecondaryApiKey).IsApiKeyValid() {
+		return logical.ErrorResponse("'secondary_api_key' is not valid.")
+	}
+	return nil
 }
 
 type config struct {
+	SchemaVersion int
+
 	ApiKey string
 	Domain string
 	TTL    time.Duration
 	MaxTTL time.Duration
+
+	Region   string
+	SmtpHost string
+	SmtpPort int
+
+	Version     int
+	HistorySize int
+
+	ApiKeyFingerprint string
+	ApiKeySetAt       time.Time
+
+	SecondaryApiKey            string
+	SecondaryApiKeyFingerprint string
+
+	VerboseLogging bool
+
+	WebhookSigningKey string
+
+	MonitorInterval    time.Duration
+	InventoryRetention time.Duration
+
+	StatsdAddress   string
+	StatsiteAddress string
+}
+
+func (cfg *config) historySize() int {
+	if cfg.HistorySize == 0 {
+		return defaultConfigHistorySize
+	}
+	return cfg.HistorySize
+}
+
+func (cfg *config) monitorInterval() time.Duration {
+	if cfg.MonitorInterval == 0 {
+		return defaultMonitorInterval
+	}
+	return cfg.MonitorInterval
+}
+
+func (cfg *config) inventoryRetention() time.Duration {
+	if cfg.InventoryRetention == 0 {
+		return defaultInventoryRetention
+	}
+	return cfg.InventoryRetention
+}
+
+func (cfg *config) region() string {
+	if cfg.Region == "" {
+		return regionUS
+	}
+	return cfg.Region
+}
+
+func (cfg *config) smtpHost() string {
+	if cfg.SmtpHost == "" {
+		return regionSmtpHost[cfg.region()]
+	}
+	return cfg.SmtpHost
+}
+
+func (cfg *config) smtpPort() int {
+	if cfg.SmtpPort == 0 {
+		return defaultSmtpPort
+	}
+	return cfg.SmtpPort
 }
 
 func getConfig(ctx context.Context, s logical.Storage) (*config, error) {
@@ -138,9 +526,62 @@ func getConfig(ctx context.Context, s logical.Storage) (*config, error) {
 		return nil, err
 	}
 
+	if _, err := upgradeConfig(ctx, s, &cfg); err != nil {
+		return nil, err
+	}
+
 	return &cfg, err
 }
 
+// putConfig stores cfg as a new version of the config and records it in the
+// config history. rolledBackFrom is the restored version for a rollback.
+func (b *mailgunBackend) putConfig(ctx context.Context, req *logical.Request, cfg *config, rolledBackFrom int) error {
+	current, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.ApiKey != cfg.ApiKey || cfg.ApiKeyFingerprint == "" {
+		cfg.ApiKeyFingerprint, err = b.apiKeyFingerprint(ctx, req.Storage, cfg.ApiKey)
+		if err != nil {
+			return err
+		}
+	}
+	apiKeyChanged := current == nil || current.ApiKey != cfg.ApiKey
+	if apiKeyChanged {
+		cfg.ApiKeySetAt = time.Now()
+	}
+	cfg.SecondaryApiKeyFingerprint = ""
+	if cfg.SecondaryApiKey != "" {
+		cfg.SecondaryApiKeyFingerprint, err = b.apiKeyFingerprint(ctx, req.Storage, cfg.SecondaryApiKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg.Version++
+	cfg.SchemaVersion = currentSchemaVersion
+	entry, err := logical.StorageEntryJSON("config", cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return err
+	}
+	b.Logger().Info("stored config", "version", cfg.Version, "domain", cfg.Domain, "region", cfg.region(),
+		"api_key_changed", apiKeyChanged, "rolled_back_from", rolledBackFrom)
+
+	return putConfigHistory(ctx, req, cfg, rolledBackFrom)
+}
+
+// formatTime formats t as RFC 3339, or returns an empty string if t is not set.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
 func getFieldString(key string, fields *framework.FieldData) (string, *logical.Response) {
 	valueRaw, ok := fields.GetOk(key)
 	if !ok {
@@ -157,4 +598,36 @@ const pathConfigHelpDesc = `
 The Mailgun backend requires the Mailgun API key and the domain for SMTP 
 credentials. This endpoint is used to configure those credentials as well as 
 default values for the backend in general.
+
+The API key and the domain are required on the first write only. Fields that
+are omitted on later writes keep their current value. The API key and the
+domain are only validated again when they change.
+
+A "secondary_api_key" is used for Mailgun API requests that are rejected as
+unauthorized with the primary API key. It is made the primary API key with
+"config/promote".
+
+With "verbose_logging=true" every request to the plugin and every request to
+the Mailgun API is logged at info level, without credentials.
+
+The abuse monitor and the idle timeout of roles poll the events of a
+credential at most once per "monitor_interval" (default 5m).
+
+Revoked credentials are kept in the inventory for "inventory_retention"
+(default 30 days) and deleted afterwards.
+
+The plugin runs in a process of its own and its metrics do not reach the
+telemetry of Vault. They are sent to the statsd server at "statsd_address"
+and the statsite server at "statsite_address", or dropped without either.
+
+With "validate_only=true" the config is validated against the Mailgun API,
+including unchanged fields, but not stored.
+
+Reading the configuration never returns the API key. Instead it returns a
+fingerprint of the key, consisting of its last characters and a salted HMAC,
+and the time the key was last set.
+
+Deleting the configuration with "revoke_outstanding=true" first deletes all
+SMTP logins issued by this mount in Mailgun and reports the logins that could
+not be deleted.
 `
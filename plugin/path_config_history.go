@@ -0,0 +1,277 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	configHistoryStoragePrefix = "config/history/"
+	defaultConfigHistorySize   = 10
+)
+
+func pathConfigHistoryList(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/history/?$",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathConfigHistoryList,
+				Summary:  "List the stored config versions.",
+				Responses: operationResponses(http.StatusOK, "The stored versions with their metadata.", logical.ListResponseWithInfo([]string{"1", "2"}, map[string]interface{}{
+					"1": map[string]interface{}{"written_at": "2019-01-02T15:04:05Z", "display_name": "token-admin", "entity_id": "..."},
+					"2": map[string]interface{}{"written_at": "2019-01-03T15:04:05Z", "display_name": "token-admin", "entity_id": "...", "rolled_back_from": 1},
+				}).Data),
+			},
+		},
+		HelpSynopsis:    pathConfigHistoryHelpSyn,
+		HelpDescription: pathConfigHistoryHelpDesc,
+	}
+}
+
+func pathConfigHistory(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/history/(?P<version>\\d+)$",
+		Fields: map[string]*framework.FieldSchema{
+			"version": {
+				Type:        framework.TypeInt,
+				Description: "Version of the config.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigHistoryRead,
+				Summary:  "Return a stored config version.",
+				Responses: operationResponses(http.StatusOK, "The stored version with the fields of the configuration and its metadata.", map[string]interface{}{
+					"domain":              "example.com",
+					"region":              regionUS,
+					"version":             1,
+					"api_key_fingerprint": "a1b2:hmac-sha256:...",
+					"written_at":          "2019-01-02T15:04:05Z",
+					"display_name":        "token-admin",
+					"entity_id":           "...",
+				}, http.StatusNotFound),
+			},
+		},
+		HelpSynopsis:    pathConfigHistoryHelpSyn,
+		HelpDescription: pathConfigHistoryHelpDesc,
+	}
+}
+
+func pathConfigRollback(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/rollback/(?P<version>\\d+)$",
+		Fields: map[string]*framework.FieldSchema{
+			"version": {
+				Type:        framework.TypeInt,
+				Description: "Version of the config to restore.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.pathConfigRollback,
+				Summary:   "Restore a stored config version.",
+				Responses: noContentResponses("The version is restored as the newest version.", http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathConfigHistoryHelpSyn,
+		HelpDescription: pathConfigHistoryHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathConfigHistoryList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	versions, err := listConfigHistory(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(versions))
+	keyInfo := make(map[string]interface{}, len(versions))
+	for _, version := range versions {
+		key := strconv.Itoa(version.Version)
+		keys = append(keys, key)
+		keyInfo[key] = version.metadata()
+	}
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *mailgunBackend) pathConfigHistoryRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	version, err := getConfigVersion(ctx, req.Storage, data.Get("version").(int))
+	if err != nil {
+		return nil, err
+	}
+	if version == nil {
+		return nil, nil
+	}
+
+	respData := configResponseData(&version.Config)
+	for key, value := range version.metadata() {
+		respData[key] = value
+	}
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func (b *mailgunBackend) pathConfigRollback(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	versionNumber := data.Get("version").(int)
+	version, err := getConfigVersion(ctx, req.Storage, versionNumber)
+	if err != nil {
+		return nil, err
+	}
+	if version == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Config version %d does not exist.", versionNumber)), nil
+	}
+
+	current, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	restored := version.Config
+	if resp := b.validateConfig(&restored); resp != nil {
+		return resp, nil
+	}
+	// The restored config becomes the newest version.
+	restored.Version = 0
+	if current != nil {
+		restored.Version = current.Version
+	}
+
+	return nil, b.putConfig(ctx, req, &restored, versionNumber)
+}
+
+// configVersion is a stored version of the config with the metadata of the
+// write that created it.
+type configVersion struct {
+	Version        int
+	Config         config
+	WrittenAt      time.Time
+	DisplayName    string
+	EntityID       string
+	RolledBackFrom int
+}
+
+func (v *configVersion) metadata() map[string]interface{} {
+	metadata := map[string]interface{}{
+		"written_at":   formatTime(v.WrittenAt),
+		"display_name": v.DisplayName,
+		"entity_id":    v.EntityID,
+	}
+	if v.RolledBackFrom > 0 {
+		metadata["rolled_back_from"] = v.RolledBackFrom
+	}
+	return metadata
+}
+
+// putConfigHistory records cfg in the history and removes the versions
+// exceeding the configured history size.
+func putConfigHistory(ctx context.Context, req *logical.Request, cfg *config, rolledBackFrom int) error {
+	entry, err := logical.StorageEntryJSON(configHistoryKey(cfg.Version), &configVersion{
+		Version:        cfg.Version,
+		Config:         *cfg,
+		WrittenAt:      time.Now(),
+		DisplayName:    req.DisplayName,
+		EntityID:       req.EntityID,
+		RolledBackFrom: rolledBackFrom,
+	})
+	if err != nil {
+		return err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	keys, err := req.Storage.List(ctx, configHistoryStoragePrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		version, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		if version <= cfg.Version-cfg.historySize() {
+			if err := req.Storage.Delete(ctx, configHistoryStoragePrefix+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func listConfigHistory(ctx context.Context, s logical.Storage) ([]*configVersion, error) {
+	keys, err := s.List(ctx, configHistoryStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*configVersion, 0, len(keys))
+	for _, key := range keys {
+		versionNumber, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		version, err := getConfigVersion(ctx, s, versionNumber)
+		if err != nil {
+			return nil, err
+		}
+		if version != nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+	return versions, nil
+}
+
+func getConfigVersion(ctx context.Context, s logical.Storage, version int) (*configVersion, error) {
+	var v configVersion
+	versionRaw, err := s.Get(ctx, configHistoryKey(version))
+	if err != nil {
+		return nil, err
+	}
+	if versionRaw == nil {
+		return nil, nil
+	}
+
+	if err := versionRaw.DecodeJSON(&v); err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func deleteConfigHistory(ctx context.Context, s logical.Storage) error {
+	keys, err := s.List(ctx, configHistoryStoragePrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.Delete(ctx, configHistoryStoragePrefix+key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func configHistoryKey(version int) string {
+	return configHistoryStoragePrefix + strconv.Itoa(version)
+}
+
+const pathConfigHistoryHelpSyn = `
+List, read and restore previous versions of the config.
+`
+
+const pathConfigHistoryHelpDesc = `
+Every write to "config" is stored as a new version. The last "history_size"
+versions are kept together with the time and the token display name and entity
+of the write. "config/rollback/<version>" validates a stored version against
+the Mailgun API and restores it as the newest version. Deleting the config
+deletes its history as well.
+`
@@ -0,0 +1,165 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"testing"
+)
+
+func TestPathConfigHistory(t *testing.T) {
+	t.Run("every write is listed with its writer", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:     storage,
+			Operation:   logical.UpdateOperation,
+			Path:        "config",
+			Data:        map[string]interface{}{"ttl": "1h"},
+			DisplayName: "token-ops",
+			EntityID:    "entity-1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := listConfigHistoryRequest(t, b, storage)
+
+		keys := resp.Data["keys"].([]string)
+		if len(keys) != 2 || keys[0] != "1" || keys[1] != "2" {
+			t.Fatal("Unexpected versions:", keys)
+		}
+		info := resp.Data["key_info"].(map[string]interface{})["2"].(map[string]interface{})
+		if info["display_name"] != "token-ops" || info["entity_id"] != "entity-1" {
+			t.Error("Unexpected writer:", info)
+		}
+		if info["written_at"] == "" {
+			t.Error("written_at is missing")
+		}
+	})
+
+	t.Run("history is limited to history_size", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key":      "apiKey123",
+			"domain":       "example.com",
+			"history_size": 2,
+		}, t, b, storage)
+		storeConfig(map[string]interface{}{"ttl": "1h"}, t, b, storage)
+		storeConfig(map[string]interface{}{"ttl": "2h"}, t, b, storage)
+
+		keys := listConfigHistoryRequest(t, b, storage).Data["keys"].([]string)
+
+		if len(keys) != 2 || keys[0] != "2" || keys[1] != "3" {
+			t.Error("Unexpected versions:", keys)
+		}
+	})
+
+	t.Run("api_key is not readable in history", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "config/history/1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Data["domain"] != "example.com" {
+			t.Error("Unexpected domain:", resp.Data["domain"])
+		}
+		if apiKey, ok := resp.Data["api_key"]; ok {
+			t.Error("api_key must not be readable, but was:", apiKey)
+		}
+	})
+
+	t.Run("rollback restores a previous version", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeConfig(map[string]interface{}{"domain": "wrong.example.com"}, t, b, storage)
+
+		resp := rollbackConfig("1", t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Rollback failed:", resp.Error())
+		}
+		cfg := requestConfig(t, b, storage)
+		if cfg.Data["domain"] != "example.com" {
+			t.Error("domain was not restored:", cfg.Data["domain"])
+		}
+		if cfg.Data["version"] != 3 {
+			t.Error("Restored config should be version 3 but is", cfg.Data["version"])
+		}
+	})
+
+	t.Run("rollback validates the version", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeConfig(map[string]interface{}{"domain": "example.org"}, t, b, storage)
+		b.MailgunFactory = generateMailgunClientFactory(false, true)
+
+		resp := rollbackConfig("1", t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("Rollback to invalid version was successful")
+		}
+		if domain := requestConfig(t, b, storage).Data["domain"]; domain != "example.org" {
+			t.Error("Invalid version was restored:", domain)
+		}
+	})
+
+	t.Run("unknown version cannot be restored", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		resp := rollbackConfig("42", t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("Rollback to unknown version was successful")
+		}
+	})
+
+	t.Run("deleting config deletes history", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		deleteConfig(nil, t, b, storage)
+
+		if keys, ok := listConfigHistoryRequest(t, b, storage).Data["keys"]; ok {
+			t.Error("History was not deleted:", keys)
+		}
+	})
+}
+
+func listConfigHistoryRequest(t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ListOperation,
+		Path:      "config/history/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func rollbackConfig(version string, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "config/rollback/" + version,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -2,7 +2,12 @@ package mgsecret
 
 import (
 	"context"
+	"fmt"
 	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -207,6 +212,162 @@ func TestPathConfig(t *testing.T) {
 		}
 	})
 
+	t.Run("config contains api_key fingerprint", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key": "key-0123456789abcdef",
+			"domain":  "example.com",
+		}, t, b, storage)
+
+		resp := requestConfig(t, b, storage)
+
+		fingerprint := resp.Data["api_key_fingerprint"].(string)
+		if !strings.HasPrefix(fingerprint, "cdef:hmac-sha256:") {
+			t.Error("Unexpected api_key_fingerprint:", fingerprint)
+		}
+		if strings.Contains(fingerprint, "0123456789ab") {
+			t.Error("api_key_fingerprint reveals the api_key:", fingerprint)
+		}
+		if resp.Data["api_key_set_at"] == "" {
+			t.Error("api_key_set_at is not set")
+		}
+	})
+
+	t.Run("api_key fingerprint only changes with api_key", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		before := requestConfig(t, b, storage).Data
+
+		storeConfig(map[string]interface{}{"ttl": "1h"}, t, b, storage)
+		unchanged := requestConfig(t, b, storage).Data
+		storeConfig(map[string]interface{}{"api_key": "otherApiKey"}, t, b, storage)
+		changed := requestConfig(t, b, storage).Data
+
+		if unchanged["api_key_fingerprint"] != before["api_key_fingerprint"] || unchanged["api_key_set_at"] != before["api_key_set_at"] {
+			t.Error("Fingerprint changed without new api_key:", before, unchanged)
+		}
+		if changed["api_key_fingerprint"] == before["api_key_fingerprint"] {
+			t.Error("Fingerprint did not change with new api_key")
+		}
+	})
+
+	t.Run("unknown region is not allowed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		config := map[string]interface{}{
+			"api_key": "apiKey123",
+			"domain":  "example.com",
+			"region":  "mars",
+		}
+
+		response := storeConfig(config, t, b, storage)
+
+		if !response.IsError() {
+			t.Error("Saving config with unknown region was successful")
+		}
+	})
+
+	t.Run("omitted fields keep their value on update", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key": "apiKey123",
+			"domain":  "example.com",
+			"max_ttl": "2h",
+		}, t, b, storage)
+
+		response := storeConfig(map[string]interface{}{"ttl": "1h"}, t, b, storage)
+
+		if response.IsError() {
+			t.Fatal("Updating only ttl failed:", response.Error())
+		}
+		resp := requestConfig(t, b, storage)
+		if domain := resp.Data["domain"]; domain != "example.com" {
+			t.Error("domain should be example.com but is", domain)
+		}
+		if ttl := getTTL(resp.Data, t); ttl != time.Hour {
+			t.Error("ttl should be", time.Hour, "but is", ttl)
+		}
+		if maxTTL := getMaxTTL(resp.Data, t); maxTTL != 2*time.Hour {
+			t.Error("max_ttl should be", 2*time.Hour, "but is", maxTTL)
+		}
+		cfg, err := getConfig(context.Background(), storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ApiKey != "apiKey123" {
+			t.Error("api_key was not kept")
+		}
+	})
+
+	t.Run("unchanged api_key and domain are not validated again", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		b.MailgunFactory = generateMailgunClientFactory(false, false)
+
+		response := storeConfig(map[string]interface{}{"ttl": "1h"}, t, b, storage)
+
+		if response.IsError() {
+			t.Error("Unchanged api_key and domain were validated again:", response.Error())
+		}
+	})
+
+	t.Run("changed domain is validated again", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		b.MailgunFactory = generateMailgunClientFactory(false, true)
+
+		response := storeConfig(map[string]interface{}{"domain": "example.org"}, t, b, storage)
+
+		if !response.IsError() {
+			t.Error("Saving config with invalid domain was successful")
+		}
+		if domain := requestConfig(t, b, storage).Data["domain"]; domain != "example.com" {
+			t.Error("Invalid domain was saved:", domain)
+		}
+	})
+
+	t.Run("validate_only does not store config", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		response := storeConfig(map[string]interface{}{
+			"api_key":       "apiKey123",
+			"domain":        "example.com",
+			"validate_only": true,
+		}, t, b, storage)
+
+		if response.IsError() || response.Data["valid"] != true {
+			t.Error("Valid config was not reported as valid:", response)
+		}
+		if resp := requestConfig(t, b, storage); resp != nil {
+			t.Error("Validated config was stored:", resp)
+		}
+	})
+
+	t.Run("validate_only reports invalid config without touching the stored one", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		b.MailgunFactory = generateMailgunClientFactory(false, true)
+
+		response := storeConfig(map[string]interface{}{
+			"domain":        "example.org",
+			"validate_only": true,
+		}, t, b, storage)
+
+		if !response.IsError() {
+			t.Error("Invalid config was reported as valid")
+		}
+		if resp := requestConfig(t, b, storage); resp.Data["domain"] != "example.com" || resp.Data["version"] != 1 {
+			t.Error("Stored config was changed:", resp.Data)
+		}
+	})
+
 	t.Run("saving invalid domain is not allowed", func(t *testing.T) {
 		t.Parallel()
 		b, storage := testBackend(t)
@@ -234,6 +395,95 @@ func TestPathConfig(t *testing.T) {
 	})
 }
 
+func TestDeleteConfig(t *testing.T) {
+	t.Run("config can be deleted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		requestCredentials(t, b, storage)
+
+		deleteConfig(nil, t, b, storage)
+
+		if resp := requestConfig(t, b, storage); resp != nil {
+			t.Error("Config was not deleted:", resp)
+		}
+		if len(testClient(b).credentials) != 1 {
+			t.Error("Logins were deleted without revoke_outstanding")
+		}
+	})
+
+	t.Run("revoke_outstanding deletes issued logins", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		credentials := requestCredentials(t, b, storage)
+
+		resp := deleteConfig(map[string]interface{}{"revoke_outstanding": true}, t, b, storage)
+
+		if len(testClient(b).credentials) != 0 {
+			t.Error("Logins were not deleted:", testClient(b).credentials)
+		}
+		if revoked := resp.Data["revoked"].([]string); len(revoked) != 3 || revoked[0] != credentials.Data["username"] {
+			t.Error("Unexpected revoked logins:", revoked)
+		}
+		if resp := requestConfig(t, b, storage); resp != nil {
+			t.Error("Config was not deleted:", resp)
+		}
+	})
+
+	t.Run("revoke_outstanding reports logins that could not be deleted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		credentials := requestCredentials(t, b, storage)
+		username := credentials.Data["username"].(string)
+		testClient(b).deleteErrors[strings.TrimSuffix(username, "@example.com")] = fmt.Errorf("mailgun unavailable")
+
+		resp := deleteConfig(map[string]interface{}{"revoke_outstanding": true}, t, b, storage)
+
+		failed := resp.Data["failed"].(map[string]string)
+		if failed[username] != "mailgun unavailable" {
+			t.Error("Failed login was not reported:", failed)
+		}
+		if len(resp.Warnings) == 0 {
+			t.Error("Failed login did not add a warning")
+		}
+	})
+
+	t.Run("leases of revoked logins can be revoked after delete", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		credentials := requestCredentials(t, b, storage)
+		deleteConfig(map[string]interface{}{"revoke_outstanding": true}, t, b, storage)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.RevokeOperation,
+			Secret:    credentials.Secret,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.IsError() {
+			t.Error("Revoking lease after delete failed:", resp.Error())
+		}
+	})
+}
+
+func deleteConfig(data map[string]interface{}, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.DeleteOperation,
+		Path:      "config",
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
 func getTTL(data map[string]interface{}, t *testing.T) time.Duration {
 	ttlRaw, ok := data["ttl"]
 	if !ok {
@@ -303,27 +553,159 @@ func storeConfig(config map[string]interface{}, t *testing.T, b *mailgunBackend,
 }
 
 func generateMailgunClientFactory(validDomain, validApiKey bool) func(_, _ string) MailgunClient {
+	client := newTestMailgunClient(validDomain, validApiKey)
 	return func(_, _ string) MailgunClient {
-		return testMailgunClient{validDomain, validApiKey}
+		return client
 	}
 }
 
+// testMailgunClient is an in-memory stand-in for the Mailgun API. One
+// instance is shared by all clients a test backend creates.
 type testMailgunClient struct {
+	sync.Mutex
 	validDomain, validApiKey bool
+	credentials              map[string]string
+	lists                    map[string][]interface{}
+	deleteErrors             map[string]error
+	createError              error
+	// events are the events of the domain, events without envelope are sent by
+	// their key. eventRequests counts their requests.
+	events        map[string][]mailgun.Event
+	eventRequests int
+	// credentialRequests counts the requests of all SMTP logins.
+	credentialRequests int
+	// Suppression lists by address.
+	bounces      map[string]mailgun.Bounce
+	unsubscribes map[string]mailgun.Unsubscription
+	complaints   map[string]mailgun.Complaint
 }
 
-func (c testMailgunClient) IsDomainValid() bool {
+func newTestMailgunClient(validDomain, validApiKey bool) *testMailgunClient {
+	return &testMailgunClient{
+		validDomain:  validDomain,
+		validApiKey:  validApiKey,
+		credentials:  map[string]string{},
+		lists:        map[string][]interface{}{},
+		deleteErrors: map[string]error{},
+		events:       map[string][]mailgun.Event{},
+		bounces:      map[string]mailgun.Bounce{},
+		unsubscribes: map[string]mailgun.Unsubscription{},
+		complaints:   map[string]mailgun.Complaint{},
+	}
+}
+
+func testClient(b *mailgunBackend) *testMailgunClient {
+	return b.MailgunFactory("", "").(*testMailgunClient)
+}
+
+func (c *testMailgunClient) IsDomainValid() bool {
 	return c.validDomain
 }
 
-func (c testMailgunClient) IsApiKeyValid() bool {
+func (c *testMailgunClient) IsApiKeyValid() bool {
 	return c.validApiKey
 }
 
-func (c testMailgunClient) DeleteCredential(username string) error {
+func (c *testMailgunClient) DeleteCredential(username string) error {
+	c.Lock()
+	defer c.Unlock()
+	if err, ok := c.deleteErrors[username]; ok {
+		return err
+	}
+	if _, ok := c.credentials[username]; !ok {
+		return errTestNotFound
+	}
+	delete(c.credentials, username)
+	return nil
+}
+
+func (c *testMailgunClient) CreateCredential(login, password string) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.createError != nil {
+		return c.createError
+	}
+	c.credentials[login] = password
 	return nil
 }
 
-func (c testMailgunClient) CreateCredential(login, password string) error {
+func (c *testMailgunClient) ChangeCredentialPassword(login, password string) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.credentials[login]; !ok {
+		return fmt.Errorf("credential %s does not exist", login)
+	}
+	c.credentials[login] = password
 	return nil
 }
+
+func (c *testMailgunClient) ListAllCredentials() ([]mailgun.Credential, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.credentialRequests++
+	credentials := make([]mailgun.Credential, 0, len(c.credentials))
+	for login, password := range c.credentials {
+		credentials = append(credentials, mailgun.Credential{Login: login + "@example.com", Password: password})
+	}
+	return credentials, nil
+}
+
+func (c *testMailgunClient) CreateList(prototype mailgun.List) (mailgun.List, error) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.lists[prototype.Address]; ok {
+		return mailgun.List{}, fmt.Errorf("list %s already exists", prototype.Address)
+	}
+	c.lists[prototype.Address] = nil
+	return prototype, nil
+}
+
+func (c *testMailgunClient) CreateMemberList(_ *bool, address string, newMembers []interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.lists[address]; !ok {
+		return fmt.Errorf("list %s does not exist", address)
+	}
+	c.lists[address] = append(c.lists[address], newMembers...)
+	return nil
+}
+
+func (c *testMailgunClient) DeleteList(address string) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.lists[address]; !ok {
+		return errTestNotFound
+	}
+	delete(c.lists, address)
+	return nil
+}
+
+func (c *testMailgunClient) GetListByAddress(address string) (mailgun.List, error) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.lists[address]; !ok {
+		return mailgun.List{}, errTestNotFound
+	}
+	return mailgun.List{Address: address}, nil
+}
+
+func (c *testMailgunClient) ListSenderEvents(sender string, since time.Time, limit int) ([]mailgun.Event, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.eventRequests++
+	var events []mailgun.Event
+	for key, keyEvents := range c.events {
+		keySender := key
+		for _, event := range keyEvents {
+			if event.Envelope == nil {
+				event.Envelope = &mailgun.Envelope{Sender: &keySender}
+			}
+			if eventSentBy(event, sender) && time.Time(event.Timestamp).After(since) && len(events) < limit {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+var errTestNotFound = &mailgun.UnexpectedResponseError{Expected: []int{http.StatusOK}, Actual: http.StatusNotFound}
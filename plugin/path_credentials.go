@@ -4,26 +4,47 @@ import (
 	"context"
 	"fmt"
 	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/helper/base62"
+	"github.com/hashicorp/vault/helper/parseutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/hashicorp/vault/plugins/helper/database/credsutil"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
 	"strings"
+	"time"
 )
 
 const (
 	secretTypeSmtpCredentials = "smtp_credential_key"
 	vaultUserPrefix           = "vault"
 	internalDataUser          = "user_name"
+	internalDataRole          = "role"
+	// internalDataTTL is the TTL in seconds requested when the credential was
+	// generated.
+	internalDataTTL = "ttl"
 )
 
 func pathCredentials(b *mailgunBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: "credentials",
+		Fields: map[string]*framework.FieldSchema{
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Requested Time to live (TTL) of the credentials. Capped at the max_ttl.",
+			},
+		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
-				Callback: b.generateCredentials,
-				Summary:  "Get mailgun SMTP username and password.",
+				Callback:  b.generateCredentials,
+				Summary:   "Get mailgun SMTP username and password.",
+				Responses: operationResponses(http.StatusOK, "A new SMTP credential with a lease.", smtpCredentialExample, http.StatusBadRequest),
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.generateCredentials,
+				Summary:   "Get mailgun SMTP username and password.",
+				Responses: operationResponses(http.StatusOK, "A new SMTP credential with a lease.", smtpCredentialExample, http.StatusBadRequest),
 			},
 		},
 		HelpSynopsis:    pathCredentialsSyn,
@@ -31,27 +52,140 @@ func pathCredentials(b *mailgunBackend) *framework.Path {
 	}
 }
 
-func secretCredentials(b *mailgunBackend) *framework.Secret {
-	return &framework.Secret{
-		Type: secretTypeSmtpCredentials,
+func pathRoleCredentials(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "credentials/" + framework.GenericNameRegex("role"),
 		Fields: map[string]*framework.FieldSchema{
-			"username": {
+			"role": {
 				Type:        framework.TypeString,
-				Description: "The SMTP username for mailgun.",
+				Description: "Name of the role to generate the credential for.",
 			},
-			"password": {
-				Type:        framework.TypeString,
-				Description: "The SMTP password for mailgun.",
+			"members": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Addresses to add to a generated mailing list. Only used by roles of type mailing_list.",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Requested Time to live (TTL) of the credential. Capped at the max_ttl.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback:  b.generateRoleCredentials,
+				Summary:   "Generate a credential for the role.",
+				Responses: roleCredentialResponses,
 			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.generateRoleCredentials,
+				Summary:   "Generate a credential for the role.",
+				Responses: roleCredentialResponses,
+			},
+		},
+		HelpSynopsis:    pathRoleCredentialsSyn,
+		HelpDescription: pathRoleCredentialsDesc,
+	}
+}
+
+// smtpCredentialExample is the example data of a generated SMTP credential.
+var smtpCredentialExample = map[string]interface{}{
+	"username":   "vault.k3x9a@example.com",
+	"password":   "...",
+	"smtp_host":  defaultSmtpHost,
+	"smtp_port":  defaultSmtpPort,
+	"smtp_tls":   smtpTlsStartTls,
+	"smtp_ports": smtpPorts,
+}
+
+// roleCredentialResponses are the responses of the operations generating a
+// credential for a role, depending on the type of the role.
+var roleCredentialResponses = map[int][]framework.Response{
+	http.StatusOK: {
+		{
+			Description: "A new SMTP credential or mailing list with a lease.",
+			Example:     &logical.Response{Data: smtpCredentialExample},
 		},
+		{
+			Description: "A new mailing list with a lease.",
+			Example: &logical.Response{Data: map[string]interface{}{
+				"address": "loadtest-x3k9a@example.com",
+			}},
+		},
+	},
+	http.StatusBadRequest:          {errorResponses[http.StatusBadRequest]},
+	http.StatusInternalServerError: {errorResponses[http.StatusInternalServerError]},
+}
+
+func secretCredentials(b *mailgunBackend) *framework.Secret {
+	return &framework.Secret{
+		Type:   secretTypeSmtpCredentials,
+		Fields: smtpCredentialFields(),
 		Renew:  b.secretCredentialsRenew,
 		Revoke: b.secretCredentialsRevoke,
 	}
 }
 
 func (b *mailgunBackend) secretCredentialsRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	resp := logical.Response{Secret: req.Secret}
-	return &resp, nil
+	username, ok := req.Secret.InternalData[internalDataUser]
+	if !ok {
+		return nil, fmt.Errorf("no internal user name found")
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+	r, resp, err := getLeaseRole(ctx, req.Storage, req)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	op := b.startLeaseOperation(operationRenew, req, config, r)
+	if resp := b.checkLoginExists(op, config, username.(string)); resp != nil {
+		return resp, nil
+	}
+
+	return b.renewLease(op, req, config, r)
+}
+
+// checkLoginExists returns an error response if the SMTP login does not
+// exist in mailgun any longer, so its lease is not renewed.
+func (b *mailgunBackend) checkLoginExists(op *credentialOperation, config *config, login string) *logical.Response {
+	address := fmt.Sprintf("%s@%s", login, config.Domain)
+	exists, err := b.credentialExists(b.client(config), config.Domain, address)
+	if err != nil {
+		op.failed(classifyError(err), err)
+		return logical.ErrorResponse(fmt.Sprintf("Unable to look up credentials in mailgun: %v", err))
+	}
+	if !exists {
+		err := fmt.Errorf("SMTP login '%s' does not exist in mailgun any longer", address)
+		op.failed(errorClassNotFound, err)
+		return logical.ErrorResponse(err.Error() + ".")
+	}
+	return nil
+}
+
+// renewLease extends the lease by the TTL of the current role and config, or
+// the shorter TTL requested when the credential was generated, capped at
+// their max TTL and the limits of the mount.
+func (b *mailgunBackend) renewLease(op *credentialOperation, req *logical.Request, config *config, r *role) (*logical.Response, error) {
+	ttl, maxTTL := r.leaseTTLs(config)
+	if requested, err := parseutil.ParseDurationSecond(req.Secret.InternalData[internalDataTTL]); err == nil && requested > 0 && (ttl <= 0 || requested < ttl) {
+		ttl = requested
+	}
+	ttl, warnings, err := framework.CalculateTTL(b.System(), req.Secret.Increment, ttl, 0, maxTTL, 0, req.Secret.IssueTime)
+	if err != nil {
+		op.failed(errorClassOther, err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	op.succeeded()
+
+	resp := &logical.Response{Secret: req.Secret}
+	resp.Secret.TTL = ttl
+	resp.Secret.MaxTTL = maxTTL
+	for _, warning := range warnings {
+		resp.AddWarning(warning)
+	}
+	return resp, nil
 }
 
 func (b *mailgunBackend) secretCredentialsRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -60,21 +194,123 @@ func (b *mailgunBackend) secretCredentialsRevoke(ctx context.Context, req *logic
 		return nil, fmt.Errorf("no internal user name found")
 	}
 
+	lock := b.inventoryLock(username.(string))
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Deleting the config with revoke_outstanding may have revoked the login
+	// already.
+	entry, err := getInventoryEntry(ctx, req.Storage, username.(string))
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && entry.revoked() {
+		return nil, nil
+	}
+
 	config, err := getConfig(ctx, req.Storage)
-	if ok, response, err := handleGetConfigErrors(err, config); !ok {
-		return response, err
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to get configuration: {{err}}", err)
+	}
+	if config == nil {
+		// Without a config the login cannot be deleted any longer. Failing
+		// would only keep the lease around forever.
+		b.Logger().Warn("config deleted, SMTP login of revoked lease is left in mailgun", "username", username)
+		return nil, markInventoryRevoked(ctx, req.Storage, username.(string), revokedReasonLease)
 	}
 
-	client := b.MailgunFactory(config.Domain, config.ApiKey)
+	client := b.client(config)
 
-	if err = client.DeleteCredential(username.(string)); err != nil {
-		return logical.ErrorResponse("Unable to create credentials in mailgun. Configure with valid credentials"), nil
+	op := b.startLeaseOperation(operationDelete, req, config, &role{CredentialType: credentialTypeSmtp})
+	// A login deleted in mailgun already is revoked as well.
+	err = client.DeleteCredential(username.(string))
+	if err != nil && mailgun.GetStatusFromErr(err) != http.StatusNotFound {
+		op.failed(classifyError(err), err)
+		return logical.ErrorResponse(fmt.Sprintf("Unable to delete credentials in mailgun: %v", err)), nil
 	}
 
+	if err := markInventoryRevoked(ctx, req.Storage, username.(string), revokedReasonLease); err != nil {
+		op.failed(errorClassStorage, err)
+		return nil, err
+	}
+	op.succeeded()
 	return nil, nil
 }
 
 func (b *mailgunBackend) generateCredentials(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+	// Mounts upgraded from a single config use the "default" role.
+	roleName, r := defaultRoleName, (*role)(nil)
+	if r, err = getRole(ctx, req.Storage, defaultRoleName); err != nil {
+		return nil, errwrap.Wrapf("Unable to get role: {{err}}", err)
+	}
+	if r == nil || r.CredentialType != credentialTypeSmtp {
+		roleName, r = "", newRole()
+	}
+
+	resp, err := b.generateSmtpCredentials(ctx, req, config, roleName, r)
+	b.applyRequestedTTL(resp, d)
+	return resp, err
+}
+
+func (b *mailgunBackend) generateRoleCredentials(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	roleName := d.Get("role").(string)
+	r, err := getRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to get role: {{err}}", err)
+	}
+	if r == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Role '%s' does not exist.", roleName)), nil
+	}
+
+	var resp *logical.Response
+	switch r.CredentialType {
+	case credentialTypeMailingList:
+		resp, err = b.generateMailingList(ctx, req, config, roleName, r, d.Get("members").([]string))
+	case credentialTypeLibrary:
+		return logical.ErrorResponse(fmt.Sprintf("Role '%s' is a library role. Use library/%s/check-out.", roleName, roleName)), nil
+	default:
+		resp, err = b.generateSmtpCredentials(ctx, req, config, roleName, r)
+	}
+	b.applyRequestedTTL(resp, d)
+	return resp, err
+}
+
+// applyRequestedTTL replaces the lease TTL of a generated credential with the
+// TTL requested by the caller. The TTL is capped at the max TTL of the role or
+// config and the max lease TTL of the mount.
+func (b *mailgunBackend) applyRequestedTTL(resp *logical.Response, d *framework.FieldData) {
+	if resp == nil || resp.Secret == nil {
+		return
+	}
+	ttlRaw, ok := d.GetOk("ttl")
+	if !ok || ttlRaw.(int) <= 0 {
+		return
+	}
+
+	ttl := time.Duration(ttlRaw.(int)) * time.Second
+	maxTTL := b.System().MaxLeaseTTL()
+	if resp.Secret.MaxTTL > 0 && resp.Secret.MaxTTL < maxTTL {
+		maxTTL = resp.Secret.MaxTTL
+	}
+	if ttl > maxTTL {
+		resp.AddWarning(fmt.Sprintf("Requested ttl %s exceeds the max_ttl and was capped at %s.", ttl, maxTTL))
+		ttl = maxTTL
+	}
+	resp.Secret.TTL = ttl
+	// Renewals extend the lease by the requested TTL as well.
+	resp.Secret.InternalData[internalDataTTL] = int64(ttl / time.Second)
+}
+
+func (b *mailgunBackend) generateSmtpCredentials(ctx context.Context, req *logical.Request, config *config, roleName string, r *role) (*logical.Response, error) {
 	username, err := generateUsername()
 	if err != nil {
 		return nil, err
@@ -84,27 +320,46 @@ func (b *mailgunBackend) generateCredentials(ctx context.Context, req *logical.R
 		return nil, err
 	}
 
-	config, err := getConfig(ctx, req.Storage)
-	if ok, response, err := handleGetConfigErrors(err, config); !ok {
-		return response, err
-	}
-	client := b.MailgunFactory(config.Domain, config.ApiKey)
+	op := b.startOperation(operationCreate, credentialTypeSmtp, roleName, config.Domain, username)
+	client := b.client(config)
 	if err = client.CreateCredential(username, password); err != nil {
+		op.failed(classifyError(err), err)
 		return logical.ErrorResponse(fmt.Sprintf("Unable to create credentials in mailgun: %v", err)), nil
 	}
 
-	secretD := map[string]interface{}{
-		"username": fmt.Sprintf("%s@%s", username, config.Domain),
-		"password": password,
+	address := fmt.Sprintf("%s@%s", username, config.Domain)
+	if r.VerifySmtp {
+		if err = b.waitForSmtpAuth(ctx, config, r.VerifySmtpTimeout, address, password); err != nil {
+			op.failed(errorClassSmtpVerification, err)
+			if deleteErr := client.DeleteCredential(username); deleteErr != nil {
+				return nil, fmt.Errorf("unable to delete unverified credential %s: %v", username, deleteErr)
+			}
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	err = putInventoryEntry(ctx, req.Storage, newInventoryEntry(req, username, credentialTypeSmtp, config.Domain, roleName))
+	if err != nil {
+		op.failed(errorClassStorage, err)
+		// Without a lease nothing would ever delete the login.
+		if deleteErr := client.DeleteCredential(username); deleteErr != nil {
+			return nil, multierror.Append(err, fmt.Errorf("unable to delete credential %s: %v", username, deleteErr))
+		}
+		return nil, err
 	}
+	op.succeeded()
+
+	secretD := smtpConnectionData(config, address, password, r.OutputFormats)
+	secretD["username"] = address
+	secretD["password"] = password
 	internalD := map[string]interface{}{
 		internalDataUser: username,
+		internalDataRole: roleName,
 	}
 
 	secret := b.Secret(secretTypeSmtpCredentials)
 	resp := secret.Response(secretD, internalD)
-	resp.Secret.TTL = config.TTL
-	resp.Secret.MaxTTL = config.MaxTTL
+	resp.Secret.TTL, resp.Secret.MaxTTL = r.leaseTTLs(config)
 	resp.Secret.Renewable = true
 	return resp, nil
 }
@@ -140,7 +395,19 @@ func handleGetConfigErrors(err error, config *config) (bool, *logical.Response,
 const pathCredentialsSyn = `Generate Mailgun SMTP username and password.`
 const pathCredentialsDesc = `
 This path will generate new SMTP username and password for Mailgun.
-The Mailgun SMTP server has following settings:
-Server: smtp.mailgun.org
-Ports 25, 587, and 465 (SSL/TLS)
+The response also contains the SMTP server of the configured region:
+"smtp_host", "smtp_port" with its TLS mode "smtp_tls" and all "smtp_ports"
+offered by Mailgun. By default the server is smtp.mailgun.org with the ports
+25, 587 and 2525 (STARTTLS) and 465 (SSL/TLS).
+Writing to this path with the "ttl" parameter requests a TTL other than the
+configured one. It is capped at the configured max_ttl.
+`
+
+const pathRoleCredentialsSyn = `Generate a credential for a role.`
+const pathRoleCredentialsDesc = `
+This path generates a credential of the type configured in the role.
+Roles of type "smtp" return a new SMTP username and password, roles of type
+"mailing_list" return the address of a new mailing list. Members for the
+mailing list can be passed with the "members" parameter on write.
+The "ttl" parameter requests a TTL other than the one of the role.
 `
@@ -2,7 +2,9 @@ package mgsecret
 
 import (
 	"context"
+	"fmt"
 	"github.com/hashicorp/vault/logical"
+	"strings"
 	"testing"
 	"time"
 )
@@ -95,4 +97,206 @@ func TestPathCredentials(t *testing.T) {
 			t.Error("Credential ttl should be", expectedMaxTTL, "but is", secret.MaxTTL)
 		}
 	})
+
+	t.Run("role credentials use role ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("test", map[string]interface{}{
+			"ttl": "1h",
+		}, t, b, storage)
+
+		resp := requestRoleCredentials("test", nil, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Configured role is an error but should not")
+		}
+		if resp.Secret.TTL != time.Hour {
+			t.Error("Credential ttl should be", time.Hour, "but is", resp.Secret.TTL)
+		}
+		if _, ok := resp.Data["password"]; !ok {
+			t.Error("Response does not contain password")
+		}
+	})
+
+	t.Run("unknown role does not provide credentials", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		resp := requestRoleCredentials("unknown", nil, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("Unknown role still created credentials:", resp.Secret)
+		}
+	})
+
+	t.Run("credentials contain smtp connection details of the region", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key": "apiKey123",
+			"domain":  "example.com",
+			"region":  "eu",
+		}, t, b, storage)
+
+		resp := requestCredentials(t, b, storage)
+
+		if host := resp.Data["smtp_host"]; host != "smtp.eu.mailgun.org" {
+			t.Error("smtp_host should be smtp.eu.mailgun.org but is", host)
+		}
+		if port := resp.Data["smtp_port"]; port != 587 {
+			t.Error("smtp_port should be 587 but is", port)
+		}
+		if tls := resp.Data["smtp_tls"]; tls != smtpTlsStartTls {
+			t.Error("smtp_tls should be", smtpTlsStartTls, "but is", tls)
+		}
+	})
+
+	t.Run("role output formats are added to credentials", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key":   "apiKey123",
+			"domain":    "example.com",
+			"smtp_port": 465,
+		}, t, b, storage)
+		storeRole("test", map[string]interface{}{
+			"output_formats": "smtp_uri,postfix_sasl_passwd",
+		}, t, b, storage)
+
+		resp := requestRoleCredentials("test", nil, t, b, storage)
+
+		username, password := resp.Data["username"].(string), resp.Data["password"].(string)
+		expectedUri := fmt.Sprintf("smtps://%s:%s@smtp.mailgun.org:465", strings.Replace(username, "@", "%40", 1), password)
+		if uri := resp.Data["smtp_uri"]; uri != expectedUri {
+			t.Error("smtp_uri should be", expectedUri, "but is", uri)
+		}
+		expectedSaslPasswd := fmt.Sprintf("[smtp.mailgun.org]:465 %s:%s\n", username, password)
+		if saslPasswd := resp.Data["postfix_sasl_passwd"]; saslPasswd != expectedSaslPasswd {
+			t.Error("postfix_sasl_passwd should be", expectedSaslPasswd, "but is", saslPasswd)
+		}
+	})
+
+	t.Run("requested ttl is used", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		resp := writeCredentials(map[string]interface{}{"ttl": "10m"}, t, b, storage)
+
+		if resp.Secret.TTL != 10*time.Minute {
+			t.Error("Credential ttl should be", 10*time.Minute, "but is", resp.Secret.TTL)
+		}
+	})
+
+	t.Run("requested ttl is capped at max_ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key": "apiKey123",
+			"domain":  "example.com",
+			"max_ttl": "1h",
+		}, t, b, storage)
+
+		resp := writeCredentials(map[string]interface{}{"ttl": "2h"}, t, b, storage)
+
+		if resp.Secret.TTL != time.Hour {
+			t.Error("Credential ttl should be", time.Hour, "but is", resp.Secret.TTL)
+		}
+		if len(resp.Warnings) == 0 {
+			t.Error("Capping the ttl did not add a warning")
+		}
+	})
+
+	t.Run("requested ttl is capped at mount max ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		mountMaxTTL := b.System().MaxLeaseTTL()
+
+		resp := writeCredentials(map[string]interface{}{"ttl": int((mountMaxTTL + time.Hour) / time.Second)}, t, b, storage)
+
+		if resp.Secret.TTL != mountMaxTTL {
+			t.Error("Credential ttl should be", mountMaxTTL, "but is", resp.Secret.TTL)
+		}
+	})
+
+	t.Run("revoking a login deleted in mailgun succeeds", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		credentials := requestCredentials(t, b, storage)
+		username := credentials.Secret.InternalData[internalDataUser].(string)
+		delete(testClient(b).credentials, username)
+
+		if resp := revokeSecret(credentials.Secret, t, b, storage); resp.IsError() {
+			t.Fatal("Revoke failed:", resp.Error())
+		}
+
+		if resp := readInventory(username, t, b, storage); resp.Data["revoked"] != true {
+			t.Error("Inventory entry was not marked revoked:", resp.Data)
+		}
+	})
+
+	t.Run("login is deleted if it cannot be stored", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   &failingStorage{Storage: storage, prefix: inventoryStoragePrefix},
+			Operation: logical.ReadOperation,
+			Path:      "credentials",
+		})
+
+		if err == nil {
+			t.Error("storage error should be returned")
+		}
+		if logins := testClient(b).credentials; len(logins) != 0 {
+			t.Error("login should be deleted in mailgun:", logins)
+		}
+	})
+
+	t.Run("revoking without config succeeds", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		credentials := requestCredentials(t, b, storage)
+		deleteConfig(nil, t, b, storage)
+
+		if resp := revokeSecret(credentials.Secret, t, b, storage); resp.IsError() {
+			t.Fatal("Revoke failed:", resp.Error())
+		}
+
+		username := credentials.Secret.InternalData[internalDataUser].(string)
+		if resp := readInventory(username, t, b, storage); resp.Data["revoked"] != true {
+			t.Error("Inventory entry was not marked revoked:", resp.Data)
+		}
+	})
+}
+
+func writeCredentials(data map[string]interface{}, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "credentials",
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func requestCredentials(t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "credentials",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
 }
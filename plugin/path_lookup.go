@@ -0,0 +1,224 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+	"strings"
+)
+
+func pathLookup(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "lookup/(?P<username>[^/]+)$",
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "SMTP username, with or without domain, or mailing list address.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathLookupRead,
+				Summary:  "Return who requested a credential.",
+				Responses: operationResponses(http.StatusOK, "The requester and the lease of the credential.", map[string]interface{}{
+					"username":        "vault.k3x9a@example.com",
+					"credential_type": credentialTypeSmtp,
+					"role":            "ci",
+					"entity_id":       "...",
+					"display_name":    "token-ci",
+					"lease_prefix":    "mailgun/credentials/ci",
+					"created_at":      "2019-01-02T15:04:05Z",
+					"last_used_at":    "",
+					"revoked":         false,
+					"revoked_at":      "",
+					"revoked_reason":  "",
+				}, http.StatusNotFound),
+			},
+		},
+		HelpSynopsis:    pathLookupHelpSyn,
+		HelpDescription: pathLookupHelpDesc,
+	}
+}
+
+func pathLookupDisable(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "lookup/(?P<username>[^/]+)/disable$",
+		Fields: map[string]*framework.FieldSchema{
+			"username": {
+				Type:        framework.TypeString,
+				Description: "SMTP username, with or without domain, or mailing list address.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathLookupDisable,
+				Summary:  "Disable a credential in Mailgun, without revoking its lease.",
+				Responses: operationResponses(http.StatusOK, "The disabled credential, with a warning how to revoke its lease.", map[string]interface{}{
+					"username":        "vault.k3x9a@example.com",
+					"credential_type": credentialTypeSmtp,
+					"role":            "ci",
+					"entity_id":       "...",
+					"display_name":    "token-ci",
+					"lease_prefix":    "mailgun/credentials/ci",
+					"created_at":      "2019-01-02T15:04:05Z",
+					"last_used_at":    "",
+					"revoked":         true,
+					"revoked_at":      "2019-01-02T17:04:05Z",
+					"revoked_reason":  revokedReasonLookupDisable,
+				}, http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathLookupHelpSyn,
+		HelpDescription: pathLookupHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathLookupRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entry, err := lookupInventoryEntry(ctx, req.Storage, data.Get("username").(string))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	return &logical.Response{Data: lookupResponseData(entry)}, nil
+}
+
+func (b *mailgunBackend) pathLookupDisable(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	username := data.Get("username").(string)
+	entry, err := lookupInventoryEntry(ctx, req.Storage, username)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Credential '%s' was not issued by this mount.", username)), nil
+	}
+
+	lock := b.inventoryLock(entry.Username)
+	lock.Lock()
+	defer lock.Unlock()
+	if entry, err = getInventoryEntry(ctx, req.Storage, entry.Username); err != nil || entry == nil {
+		return nil, err
+	}
+	if entry.revoked() {
+		return logical.ErrorResponse(fmt.Sprintf("Credential '%s' is already revoked.", username)), nil
+	}
+
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	if resp, err := b.revokeIssuedCredential(ctx, req.Storage, config, entry, revokedReasonLookupDisable); resp != nil || err != nil {
+		return resp, err
+	}
+
+	entry, err = getInventoryEntry(ctx, req.Storage, entry.Username)
+	if err != nil {
+		return nil, err
+	}
+	resp := &logical.Response{Data: lookupResponseData(entry)}
+	// Plugins cannot revoke leases, the lease stays until it expires or an
+	// operator revokes it. The revocation succeeds without deleting anything.
+	resp.AddWarning(fmt.Sprintf("The credential was disabled in Mailgun, its lease is not revoked. 'vault lease revoke -prefix %s' revokes it, together with all other leases issued on that path.", entry.LeasePrefix))
+	return resp, nil
+}
+
+// revokeIssuedCredential deletes the credential of the entry in Mailgun, or
+// checks a library login in, and marks it as revoked. The lease is left to
+// Vault, its revocation succeeds without further action afterwards. The
+// caller holds the inventory lock of the entry.
+func (b *mailgunBackend) revokeIssuedCredential(ctx context.Context, s logical.Storage, config *config, entry *inventoryEntry, reason string) (*logical.Response, error) {
+	if entry.CredentialType == credentialTypeLibrary {
+		// The login stays in the pool, checking it in rotates its password.
+		libraryEntry, err := getLibraryEntry(ctx, s, entry.Role, entry.Username)
+		if err != nil {
+			return nil, err
+		}
+		if libraryEntry == nil || !libraryEntry.CheckedOut {
+			return nil, markInventoryRevoked(ctx, s, entry.Username, reason)
+		}
+		return b.checkIn(ctx, s, entry.Role, entry.Username, libraryEntry.CheckOutID, reason)
+	}
+
+	op := b.startOperation(operationDelete, entry.CredentialType, entry.Role, entry.Domain, entry.Username)
+	client := b.client(config)
+	var err error
+	if entry.CredentialType == credentialTypeMailingList {
+		err = client.DeleteList(entry.Username)
+	} else {
+		err = client.DeleteCredential(entry.Username)
+	}
+	if err != nil {
+		op.failed(classifyError(err), err)
+		return logical.ErrorResponse(fmt.Sprintf("Unable to delete credential in mailgun: %v", err)), nil
+	}
+	if err := markInventoryRevoked(ctx, s, entry.Username, reason); err != nil {
+		op.failed(errorClassStorage, err)
+		return nil, err
+	}
+	op.succeeded()
+	return nil, nil
+}
+
+func lookupResponseData(entry *inventoryEntry) map[string]interface{} {
+	username := entry.Username
+	if entry.CredentialType != credentialTypeMailingList {
+		username = fmt.Sprintf("%s@%s", entry.Username, entry.Domain)
+	}
+	return map[string]interface{}{
+		"username":        username,
+		"credential_type": entry.CredentialType,
+		"role":            entry.Role,
+		"entity_id":       entry.EntityID,
+		"display_name":    entry.DisplayName,
+		"lease_prefix":    entry.LeasePrefix,
+		"created_at":      formatTime(entry.CreatedAt),
+		"last_used_at":    formatTime(entry.LastUsedAt),
+		"revoked":         entry.revoked(),
+		"revoked_at":      formatTime(entry.RevokedAt),
+		"revoked_reason":  entry.RevokedReason,
+	}
+}
+
+// lookupInventoryEntry returns the entry of a mailing list address, an SMTP
+// login or an SMTP login with domain. All of them are case insensitive.
+func lookupInventoryEntry(ctx context.Context, s logical.Storage, username string) (*inventoryEntry, error) {
+	entry, err := getInventoryEntry(ctx, s, username)
+	if err != nil || entry != nil {
+		return entry, err
+	}
+
+	at := strings.LastIndex(username, "@")
+	if at < 0 {
+		return nil, nil
+	}
+	entry, err = getInventoryEntry(ctx, s, username[:at])
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if !strings.EqualFold(entry.Domain, username[at+1:]) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+const pathLookupHelpSyn = `
+Look up who requested a credential.
+`
+
+const pathLookupHelpDesc = `
+Reading "lookup/<username>" returns the role, the entity ID and the token
+display name of the requester, the lease and the timestamps of a credential
+issued by this mount. The username is the SMTP login, with or without domain,
+or the address of a mailing list. Both are case insensitive.
+
+Writing to "lookup/<username>/disable" deletes the credential in Mailgun, or
+checks a library login in, and marks it as revoked in the inventory. It does
+not revoke the Vault lease, plugins cannot do that. The lease stays until it
+expires or is revoked, e.g. with "vault lease revoke -prefix <lease_prefix>",
+which revokes all leases issued on that path. Revoking the lease succeeds
+without further action.
+`
@@ -0,0 +1,140 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"strings"
+	"testing"
+)
+
+func TestPathLookup(t *testing.T) {
+	t.Run("lookup returns the requester of a username", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:     storage,
+			Operation:   logical.ReadOperation,
+			Path:        "credentials",
+			EntityID:    "entity-1",
+			DisplayName: "token-team-a",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := resp.Data["username"].(string)
+
+		for _, username := range []string{address, strings.ToUpper(address), strings.TrimSuffix(address, "@example.com")} {
+			lookup := lookupRequest(logical.ReadOperation, username, t, b, storage)
+			if lookup == nil {
+				t.Fatal("lookup of", username, "returned nothing")
+			}
+			if lookup.Data["username"] != address || lookup.Data["entity_id"] != "entity-1" || lookup.Data["display_name"] != "token-team-a" {
+				t.Error("Unexpected lookup of", username, ":", lookup.Data)
+			}
+		}
+	})
+
+	t.Run("lookup with other domain returns nothing", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		resp := requestCredentials(t, b, storage)
+		username := resp.Secret.InternalData[internalDataUser].(string)
+
+		if lookup := lookupRequest(logical.ReadOperation, username+"@other.com", t, b, storage); lookup != nil {
+			t.Error("Unexpected lookup:", lookup.Data)
+		}
+	})
+
+	t.Run("lookup of a mailing list ignores the case of the domain", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{"api_key": "apiKey123", "domain": "Example.COM"}, t, b, storage)
+		storeRole("loadtest", map[string]interface{}{"credential_type": credentialTypeMailingList}, t, b, storage)
+		address := requestRoleCredentials("loadtest", nil, t, b, storage).Data["address"].(string)
+
+		for _, username := range []string{address, strings.ToLower(address)} {
+			if lookup := lookupRequest(logical.ReadOperation, username, t, b, storage); lookup == nil || lookup.Data["username"] != address {
+				t.Error("Unexpected lookup of", username, ":", lookup)
+			}
+		}
+	})
+
+	t.Run("lookup finds entries stored with the case of the domain", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		entry, err := logical.StorageEntryJSON(inventoryStoragePrefix+"list@Example.COM", &inventoryEntry{
+			Username:       "list@Example.COM",
+			CredentialType: credentialTypeMailingList,
+			Domain:         "Example.COM",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.Put(context.Background(), entry)
+
+		if lookup := lookupRequest(logical.ReadOperation, "list@Example.COM", t, b, storage); lookup == nil {
+			t.Fatal("entry stored with the case of the domain was not found")
+		}
+		if err := b.pruneInventory(context.Background(), storage); err != nil {
+			t.Fatal(err)
+		}
+		if lookup := lookupRequest(logical.ReadOperation, "list@example.com", t, b, storage); lookup == nil {
+			t.Error("entry was not moved to its lower case key")
+		}
+	})
+
+	t.Run("disable deletes the credential", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		resp := requestCredentials(t, b, storage)
+		username := resp.Secret.InternalData[internalDataUser].(string)
+
+		disable := lookupRequest(logical.UpdateOperation, resp.Data["username"].(string), t, b, storage)
+
+		if disable.IsError() {
+			t.Fatal("Unexpected error:", disable.Error())
+		}
+		if disable.Data["revoked"] != true || disable.Data["lease_prefix"] != "credentials" {
+			t.Error("Unexpected disable response:", disable.Data)
+		}
+		if len(disable.Warnings) == 0 || !strings.Contains(disable.Warnings[0], "vault lease revoke -prefix credentials") {
+			t.Error("Missing lease revocation hint:", disable.Warnings)
+		}
+		if _, ok := testClient(b).credentials[username]; ok {
+			t.Error("credential was not deleted in mailgun")
+		}
+		if leaseRevoke := revokeSecret(resp.Secret, t, b, storage); leaseRevoke.IsError() {
+			t.Error("revoking the lease afterwards failed:", leaseRevoke.Error())
+		}
+	})
+
+	t.Run("disable of unknown username fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		if disable := lookupRequest(logical.UpdateOperation, "vault.abcde", t, b, storage); !disable.IsError() {
+			t.Error("disable of unknown username should fail")
+		}
+	})
+}
+
+func lookupRequest(operation logical.Operation, username string, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	path := "lookup/" + username
+	if operation == logical.UpdateOperation {
+		path += "/disable"
+	}
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: operation,
+		Path:      path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,148 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Classes of SMTP logins in the reconcile report.
+const (
+	reconcileManagedAndLeased   = "managed_and_leased"
+	reconcileManagedButOrphaned = "managed_but_orphaned"
+	reconcileLeasedButMissing   = "leased_but_missing"
+	reconcileUnmanaged          = "unmanaged"
+)
+
+func pathReconcile(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "reconcile/?$",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathReconcileRead,
+				Summary:  "Compare the SMTP logins in Mailgun with the credentials issued by this mount.",
+				Responses: operationResponses(http.StatusOK, "The SMTP logins per class and the number of logins per class.", map[string]interface{}{
+					"domain":               "example.com",
+					"managed_and_leased":   []string{"vault.k3x9a@example.com"},
+					"managed_but_orphaned": []string{},
+					"leased_but_missing":   []string{},
+					"unmanaged":            []string{"postmaster@example.com"},
+					"counts": map[string]int{
+						"managed_and_leased":   1,
+						"managed_but_orphaned": 0,
+						"leased_but_missing":   0,
+						"unmanaged":            1,
+					},
+				}, http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathReconcileHelpSyn,
+		HelpDescription: pathReconcileHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathReconcileRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	credentials, err := b.client(config).ListAllCredentials()
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to list SMTP logins in mailgun: %v", err)), nil
+	}
+	inMailgun := make(map[string]bool, len(credentials))
+	for _, credential := range credentials {
+		inMailgun[strings.ToLower(credential.Login)] = true
+	}
+
+	// leased are the logins this mount issued and did not revoke, revoked the
+	// ones it revoked.
+	leased := map[string]bool{}
+	revoked := map[string]bool{}
+	entries, err := listInventory(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.CredentialType != credentialTypeSmtp || !strings.EqualFold(entry.Domain, config.Domain) {
+			continue
+		}
+		address := strings.ToLower(fmt.Sprintf("%s@%s", entry.Username, entry.Domain))
+		if entry.revoked() {
+			revoked[address] = true
+		} else {
+			leased[address] = true
+		}
+	}
+	// The logins of the library pools are owned by their role.
+	roleNames, err := req.Storage.List(ctx, rolesStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, roleName := range roleNames {
+		libraryEntries, err := listLibrary(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range libraryEntries {
+			leased[strings.ToLower(fmt.Sprintf("%s@%s", entry.Login, config.Domain))] = true
+		}
+	}
+
+	report := map[string][]string{
+		reconcileManagedAndLeased:   {},
+		reconcileManagedButOrphaned: {},
+		reconcileLeasedButMissing:   {},
+		reconcileUnmanaged:          {},
+	}
+	for address := range inMailgun {
+		switch {
+		case leased[address]:
+			report[reconcileManagedAndLeased] = append(report[reconcileManagedAndLeased], address)
+		case revoked[address] || strings.HasPrefix(address, vaultUserPrefix+"."):
+			report[reconcileManagedButOrphaned] = append(report[reconcileManagedButOrphaned], address)
+		default:
+			report[reconcileUnmanaged] = append(report[reconcileUnmanaged], address)
+		}
+	}
+	for address := range leased {
+		if !inMailgun[address] {
+			report[reconcileLeasedButMissing] = append(report[reconcileLeasedButMissing], address)
+		}
+	}
+
+	respData := map[string]interface{}{
+		"domain": config.Domain,
+	}
+	counts := map[string]int{}
+	for class, addresses := range report {
+		sort.Strings(addresses)
+		respData[class] = addresses
+		counts[class] = len(addresses)
+	}
+	respData["counts"] = counts
+	return &logical.Response{Data: respData}, nil
+}
+
+const pathReconcileHelpSyn = `
+Report the differences between the SMTP logins in Mailgun and this mount.
+`
+
+const pathReconcileHelpDesc = `
+Lists all SMTP logins of the configured domain in Mailgun and compares them
+with the credentials issued by this mount. Each login is reported in one of
+these classes:
+
+  managed_and_leased    issued by this mount and not revoked, or part of a
+                        library pool
+  managed_but_orphaned  exists in Mailgun, but its lease was revoked or it has
+                        the "vault." prefix of this plugin and is not known
+  leased_but_missing    issued by this mount and not revoked, but deleted in
+                        Mailgun
+  unmanaged             not created by this plugin
+`
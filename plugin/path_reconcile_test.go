@@ -0,0 +1,78 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"reflect"
+	"testing"
+)
+
+func TestPathReconcile(t *testing.T) {
+	t.Run("logins are classified", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		leased := requestCredentials(t, b, storage).Data["username"].(string)
+		missing := requestCredentials(t, b, storage).Secret.InternalData[internalDataUser].(string)
+		client := testClient(b)
+		delete(client.credentials, missing)
+		client.credentials["vault.orphn"] = "password"
+		client.credentials["postmaster"] = "password"
+
+		resp := requestReconcile(t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Unexpected error:", resp.Error())
+		}
+		expected := map[string][]string{
+			reconcileManagedAndLeased:   {leased},
+			reconcileManagedButOrphaned: {"vault.orphn@example.com"},
+			reconcileLeasedButMissing:   {missing + "@example.com"},
+			reconcileUnmanaged:          {"postmaster@example.com"},
+		}
+		for class, addresses := range expected {
+			if !reflect.DeepEqual(resp.Data[class], addresses) {
+				t.Errorf("%s should be %v but is %v", class, addresses, resp.Data[class])
+			}
+		}
+	})
+
+	t.Run("revoked login that still exists is orphaned", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		username := requestCredentials(t, b, storage).Secret.InternalData[internalDataUser].(string)
+		if err := markInventoryRevoked(context.Background(), storage, username, revokedReasonLookupDisable); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := requestReconcile(t, b, storage)
+
+		if orphaned := resp.Data[reconcileManagedButOrphaned]; !reflect.DeepEqual(orphaned, []string{username + "@example.com"}) {
+			t.Error("revoked login should be orphaned but orphaned logins are", orphaned)
+		}
+	})
+
+	t.Run("library logins are managed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+
+		resp := requestReconcile(t, b, storage)
+
+		if counts := resp.Data["counts"].(map[string]int); counts[reconcileManagedAndLeased] != 2 || counts[reconcileManagedButOrphaned] != 0 {
+			t.Error("library logins should be managed, but counts are", counts)
+		}
+	})
+}
+
+func requestReconcile(t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "reconcile",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,473 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"time"
+)
+
+const (
+	rolesStoragePrefix = "roles/"
+
+	credentialTypeSmtp        = "smtp"
+	credentialTypeMailingList = "mailing_list"
+	credentialTypeLibrary     = "library"
+
+	defaultListAddressTemplate = "vault-{{role}}-{{random}}"
+	defaultPropagationDelay    = time.Minute
+)
+
+var (
+	credentialTypes  = []string{credentialTypeSmtp, credentialTypeMailingList, credentialTypeLibrary}
+	listAccessLevels = []string{mailgun.ReadOnly, mailgun.Members, mailgun.Everyone}
+)
+
+func pathListRoles(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/?$",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback:  b.pathRolesList,
+				Summary:   "List the configured roles.",
+				Responses: operationResponses(http.StatusOK, "The names of the roles.", listExample("ci", "loadtest")),
+			},
+		},
+		HelpSynopsis:    pathRolesHelpSyn,
+		HelpDescription: pathRolesHelpDesc,
+	}
+}
+
+func pathRoles(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of the role.",
+			},
+			"credential_type": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("Type of the generated credential. One of %v.", credentialTypes),
+				Default:     credentialTypeSmtp,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "The Time to live (TTL) of the generated credentials. Defaults to the ttl in config.",
+			},
+			"max_ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "The maximum Time to live (TTL) of the generated credentials. Defaults to the max_ttl in config.",
+			},
+			"list_address_template": {
+				Type: framework.TypeString,
+				Description: `Template for the local part of a generated mailing list address. ` +
+					`Supports {{role}}, {{random}} and {{unix_time}}. The configured domain is appended.`,
+				Default: defaultListAddressTemplate,
+			},
+			"list_access_level": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("Access level of a generated mailing list. One of %v.", listAccessLevels),
+				Default:     mailgun.ReadOnly,
+			},
+			"list_description": {
+				Type:        framework.TypeString,
+				Description: "Description of a generated mailing list.",
+			},
+			"library_size": {
+				Type:        framework.TypeInt,
+				Description: "Number of available SMTP logins kept in the pool of a library role.",
+			},
+			"library_propagation_delay": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Time a new SMTP login of a library role must exist before it is checked out.",
+				Default:     int(defaultPropagationDelay / time.Second),
+			},
+			"output_formats": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: fmt.Sprintf("Additional formats of generated SMTP credentials. Any of %v.", outputFormats),
+			},
+			"verify_smtp": {
+				Type:        framework.TypeBool,
+				Description: "Wait until the SMTP server accepts a generated SMTP credential before returning it.",
+			},
+			"verify_smtp_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Maximum time to wait for the SMTP server to accept a generated SMTP credential.",
+				Default:     int(defaultSmtpVerifyTimeout / time.Second),
+			},
+			"abuse_monitor": {
+				Type:        framework.TypeBool,
+				Description: "Revoke SMTP credentials whose sends, bounces or complaints exceed the thresholds.",
+			},
+			"abuse_window": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Time window the abuse thresholds apply to.",
+				Default:     int(defaultAbuseWindow / time.Second),
+			},
+			"abuse_max_sends": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of messages sent within the abuse window. 0 disables the threshold.",
+			},
+			"abuse_max_bounces": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of failed deliveries within the abuse window. 0 disables the threshold.",
+			},
+			"abuse_max_complaints": {
+				Type:        framework.TypeInt,
+				Description: "Maximum number of spam complaints within the abuse window. 0 disables the threshold.",
+			},
+			"idle_timeout": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Report SMTP credentials that did not send a message for this long. 0 disables the timeout.",
+			},
+			"idle_revoke": {
+				Type:        framework.TypeBool,
+				Description: "Revoke SMTP credentials that exceed the idle timeout instead of only reporting them.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathRoleRead,
+				Summary:  "Return the role.",
+				Responses: operationResponses(http.StatusOK, "The settings of the role.", map[string]interface{}{
+					"credential_type":           credentialTypeSmtp,
+					"ttl":                       600,
+					"max_ttl":                   3600,
+					"list_address_template":     "",
+					"list_access_level":         "",
+					"list_description":          "",
+					"library_size":              0,
+					"library_propagation_delay": 0,
+					"output_formats":            []string{outputFormatSmtpUri},
+					"verify_smtp":               false,
+					"verify_smtp_timeout":       int(defaultSmtpVerifyTimeout / time.Second),
+					"abuse_monitor":             false,
+					"abuse_window":              int(defaultAbuseWindow / time.Second),
+					"abuse_max_sends":           0,
+					"abuse_max_bounces":         0,
+					"abuse_max_complaints":      0,
+					"idle_timeout":              0,
+					"idle_revoke":               false,
+				}, http.StatusNotFound),
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.pathRoleWrite,
+				Summary:   "Create or update the role.",
+				Responses: noContentResponses("The role is stored.", http.StatusBadRequest),
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback:  b.pathRoleDelete,
+				Summary:   "Delete the role.",
+				Responses: noContentResponses("The role is deleted.", http.StatusBadRequest),
+			},
+		},
+
+		HelpSynopsis:    pathRolesHelpSyn,
+		HelpDescription: pathRolesHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathRolesList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, rolesStoragePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(roles), nil
+}
+
+func (b *mailgunBackend) pathRoleRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	r, err := getRole(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"credential_type":           r.CredentialType,
+			"ttl":                       int64(r.TTL / time.Second),
+			"max_ttl":                   int64(r.MaxTTL / time.Second),
+			"list_address_template":     r.ListAddressTemplate,
+			"list_access_level":         r.ListAccessLevel,
+			"list_description":          r.ListDescription,
+			"library_size":              r.LibrarySize,
+			"library_propagation_delay": int64(r.LibraryPropagationDelay / time.Second),
+			"output_formats":            r.OutputFormats,
+			"verify_smtp":               r.VerifySmtp,
+			"verify_smtp_timeout":       int64(r.VerifySmtpTimeout / time.Second),
+			"abuse_monitor":             r.AbuseMonitor,
+			"abuse_window":              int64(r.abuseWindow() / time.Second),
+			"abuse_max_sends":           r.AbuseMaxSends,
+			"abuse_max_bounces":         r.AbuseMaxBounces,
+			"abuse_max_complaints":      r.AbuseMaxComplaints,
+			"idle_timeout":              int64(r.IdleTimeout / time.Second),
+			"idle_revoke":               r.IdleRevoke,
+		},
+	}, nil
+}
+
+func (b *mailgunBackend) pathRoleWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	r, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		r = newRole()
+	}
+
+	if credentialTypeRaw, ok := data.GetOk("credential_type"); ok {
+		r.CredentialType = credentialTypeRaw.(string)
+	}
+	if !strutil.StrListContains(credentialTypes, r.CredentialType) {
+		return logical.ErrorResponse(fmt.Sprintf("'credential_type' must be one of %v.", credentialTypes)), nil
+	}
+
+	if ttlRaw, ok := data.GetOk("ttl"); ok {
+		r.TTL = time.Duration(ttlRaw.(int)) * time.Second
+	}
+	if maxTtlRaw, ok := data.GetOk("max_ttl"); ok {
+		r.MaxTTL = time.Duration(maxTtlRaw.(int)) * time.Second
+	}
+	if r.MaxTTL > 0 && r.TTL > r.MaxTTL {
+		return logical.ErrorResponse("'ttl' must not be greater than 'max_ttl'."), nil
+	}
+
+	if templateRaw, ok := data.GetOk("list_address_template"); ok {
+		r.ListAddressTemplate = templateRaw.(string)
+	}
+	if r.ListAddressTemplate == "" {
+		return logical.ErrorResponse("'list_address_template' must not be empty."), nil
+	}
+
+	if accessLevelRaw, ok := data.GetOk("list_access_level"); ok {
+		r.ListAccessLevel = accessLevelRaw.(string)
+	}
+	if !strutil.StrListContains(listAccessLevels, r.ListAccessLevel) {
+		return logical.ErrorResponse(fmt.Sprintf("'list_access_level' must be one of %v.", listAccessLevels)), nil
+	}
+
+	if descriptionRaw, ok := data.GetOk("list_description"); ok {
+		r.ListDescription = descriptionRaw.(string)
+	}
+
+	if librarySizeRaw, ok := data.GetOk("library_size"); ok {
+		r.LibrarySize = librarySizeRaw.(int)
+	}
+	if r.LibrarySize < 0 {
+		return logical.ErrorResponse("'library_size' must not be negative."), nil
+	}
+	if delayRaw, ok := data.GetOk("library_propagation_delay"); ok {
+		r.LibraryPropagationDelay = time.Duration(delayRaw.(int)) * time.Second
+	}
+
+	if formatsRaw, ok := data.GetOk("output_formats"); ok {
+		r.OutputFormats = formatsRaw.([]string)
+	}
+	for _, format := range r.OutputFormats {
+		if !strutil.StrListContains(outputFormats, format) {
+			return logical.ErrorResponse(fmt.Sprintf("'output_formats' must only contain %v.", outputFormats)), nil
+		}
+	}
+
+	if verifySmtpRaw, ok := data.GetOk("verify_smtp"); ok {
+		r.VerifySmtp = verifySmtpRaw.(bool)
+	}
+	if timeoutRaw, ok := data.GetOk("verify_smtp_timeout"); ok {
+		r.VerifySmtpTimeout = time.Duration(timeoutRaw.(int)) * time.Second
+	}
+	if r.VerifySmtp && r.VerifySmtpTimeout <= 0 {
+		return logical.ErrorResponse("'verify_smtp_timeout' must be positive."), nil
+	}
+
+	if abuseMonitorRaw, ok := data.GetOk("abuse_monitor"); ok {
+		r.AbuseMonitor = abuseMonitorRaw.(bool)
+	}
+	if abuseWindowRaw, ok := data.GetOk("abuse_window"); ok {
+		r.AbuseWindow = time.Duration(abuseWindowRaw.(int)) * time.Second
+	}
+	if maxSendsRaw, ok := data.GetOk("abuse_max_sends"); ok {
+		r.AbuseMaxSends = maxSendsRaw.(int)
+	}
+	if maxBouncesRaw, ok := data.GetOk("abuse_max_bounces"); ok {
+		r.AbuseMaxBounces = maxBouncesRaw.(int)
+	}
+	if maxComplaintsRaw, ok := data.GetOk("abuse_max_complaints"); ok {
+		r.AbuseMaxComplaints = maxComplaintsRaw.(int)
+	}
+	if r.AbuseWindow < 0 || r.AbuseMaxSends < 0 || r.AbuseMaxBounces < 0 || r.AbuseMaxComplaints < 0 {
+		return logical.ErrorResponse("'abuse_window' and the abuse thresholds must not be negative."), nil
+	}
+	if r.AbuseMonitor && r.AbuseMaxSends == 0 && r.AbuseMaxBounces == 0 && r.AbuseMaxComplaints == 0 {
+		return logical.ErrorResponse("'abuse_monitor' requires at least one abuse threshold."), nil
+	}
+	if r.AbuseMonitor && r.CredentialType != credentialTypeSmtp {
+		return logical.ErrorResponse("'abuse_monitor' is only supported for roles of type smtp."), nil
+	}
+
+	if idleTimeoutRaw, ok := data.GetOk("idle_timeout"); ok {
+		r.IdleTimeout = time.Duration(idleTimeoutRaw.(int)) * time.Second
+	}
+	if r.IdleTimeout < 0 {
+		return logical.ErrorResponse("'idle_timeout' must not be negative."), nil
+	}
+	if r.IdleTimeout > 0 && r.CredentialType != credentialTypeSmtp {
+		return logical.ErrorResponse("'idle_timeout' is only supported for roles of type smtp."), nil
+	}
+	if idleRevokeRaw, ok := data.GetOk("idle_revoke"); ok {
+		r.IdleRevoke = idleRevokeRaw.(bool)
+	}
+	if r.IdleRevoke && r.IdleTimeout == 0 {
+		return logical.ErrorResponse("'idle_revoke' requires 'idle_timeout'."), nil
+	}
+
+	if err := putRole(ctx, req.Storage, name, r); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("stored role", "role", name, "credential_type", r.CredentialType)
+	return nil, nil
+}
+
+func (b *mailgunBackend) pathRoleDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	r, err := getRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil && r.CredentialType == credentialTypeLibrary {
+		if resp, err := b.emptyLibrary(ctx, req.Storage, name); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, rolesStoragePrefix+name); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("deleted role", "role", name)
+	return nil, nil
+}
+
+type role struct {
+	SchemaVersion int
+
+	CredentialType          string
+	TTL                     time.Duration
+	MaxTTL                  time.Duration
+	ListAddressTemplate     string
+	ListAccessLevel         string
+	ListDescription         string
+	LibrarySize             int
+	LibraryPropagationDelay time.Duration
+	OutputFormats           []string
+	VerifySmtp              bool
+	VerifySmtpTimeout       time.Duration
+
+	AbuseMonitor       bool
+	AbuseWindow        time.Duration
+	AbuseMaxSends      int
+	AbuseMaxBounces    int
+	AbuseMaxComplaints int
+
+	IdleTimeout time.Duration
+	IdleRevoke  bool
+}
+
+func (r *role) abuseWindow() time.Duration {
+	if r.AbuseWindow == 0 {
+		return defaultAbuseWindow
+	}
+	return r.AbuseWindow
+}
+
+// newRole returns a role with the default settings.
+func newRole() *role {
+	return &role{
+		SchemaVersion:           currentSchemaVersion,
+		CredentialType:          credentialTypeSmtp,
+		ListAddressTemplate:     defaultListAddressTemplate,
+		ListAccessLevel:         mailgun.ReadOnly,
+		LibraryPropagationDelay: defaultPropagationDelay,
+		VerifySmtpTimeout:       defaultSmtpVerifyTimeout,
+	}
+}
+
+// leaseTTLs returns the role's TTL and max TTL, falling back to the
+// configured defaults for values the role does not set.
+func (r *role) leaseTTLs(cfg *config) (time.Duration, time.Duration) {
+	ttl, maxTTL := r.TTL, r.MaxTTL
+	if ttl == 0 {
+		ttl = cfg.TTL
+	}
+	if maxTTL == 0 {
+		maxTTL = cfg.MaxTTL
+	}
+	return ttl, maxTTL
+}
+
+// getLeaseRole returns the role a lease was issued for. Leases of the
+// "credentials" path have no role and use the config only.
+func getLeaseRole(ctx context.Context, s logical.Storage, req *logical.Request) (*role, *logical.Response, error) {
+	roleName, _ := req.Secret.InternalData[internalDataRole].(string)
+	if roleName == "" {
+		return &role{CredentialType: credentialTypeSmtp}, nil, nil
+	}
+	r, err := getRole(ctx, s, roleName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r == nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("Role '%s' does not exist any longer.", roleName)), nil
+	}
+	return r, nil, nil
+}
+
+func getRole(ctx context.Context, s logical.Storage, name string) (*role, error) {
+	var r role
+	roleRaw, err := s.Get(ctx, rolesStoragePrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if roleRaw == nil {
+		return nil, nil
+	}
+
+	if err := roleRaw.DecodeJSON(&r); err != nil {
+		return nil, err
+	}
+
+	if err := upgradeRole(&r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func putRole(ctx context.Context, s logical.Storage, name string, r *role) error {
+	r.SchemaVersion = currentSchemaVersion
+	entry, err := logical.StorageEntryJSON(rolesStoragePrefix+name, r)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+const pathRolesHelpSyn = `
+Manage the roles that can be used to generate credentials.
+`
+
+const pathRolesHelpDesc = `
+A role decides which kind of credential is generated when reading from
+"credentials/<role>" and with which TTL. Roles of type "smtp" generate SMTP
+credentials, roles of type "mailing_list" create a temporary mailing list that
+is deleted again when the lease expires. Roles of type "library" keep a pool
+of pre-created SMTP logins which are checked out with
+"library/<role>/check-out".
+`
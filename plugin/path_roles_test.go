@@ -0,0 +1,152 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"testing"
+	"time"
+)
+
+func TestPathRoles(t *testing.T) {
+	t.Run("unknown role is empty", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		resp := requestRole("unknown", t, b, storage)
+
+		if resp != nil {
+			t.Error("Unexpected role:", resp)
+		}
+	})
+
+	t.Run("role defaults to smtp credentials", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeRole("test", map[string]interface{}{}, t, b, storage)
+
+		resp := requestRole("test", t, b, storage)
+
+		if resp == nil {
+			t.Fatal("role was not saved.")
+		}
+		if credentialType := resp.Data["credential_type"]; credentialType != credentialTypeSmtp {
+			t.Error("credential_type should be", credentialTypeSmtp, "but is", credentialType)
+		}
+	})
+
+	t.Run("saving role contains ttl and max_ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeRole("test", map[string]interface{}{
+			"ttl":     "1h",
+			"max_ttl": "2h",
+		}, t, b, storage)
+
+		resp := requestRole("test", t, b, storage)
+
+		if resp == nil {
+			t.Fatal("role was not saved.")
+		}
+		if ttl := getTTL(resp.Data, t); ttl != time.Hour {
+			t.Error("ttl should be", time.Hour, "but is", ttl)
+		}
+		if maxTTL := getMaxTTL(resp.Data, t); maxTTL != 2*time.Hour {
+			t.Error("max_ttl should be", 2*time.Hour, "but is", maxTTL)
+		}
+	})
+
+	t.Run("unknown credential_type is not allowed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		response := storeRole("test", map[string]interface{}{
+			"credential_type": "unknown",
+		}, t, b, storage)
+
+		if !response.IsError() {
+			t.Error("Saving role with unknown credential_type was successful")
+		}
+		if resp := requestRole("test", t, b, storage); resp != nil {
+			t.Error("Invalid role was still saved.")
+		}
+	})
+
+	t.Run("unknown list_access_level is not allowed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		response := storeRole("test", map[string]interface{}{
+			"credential_type":   credentialTypeMailingList,
+			"list_access_level": "unknown",
+		}, t, b, storage)
+
+		if !response.IsError() {
+			t.Error("Saving role with unknown list_access_level was successful")
+		}
+	})
+
+	t.Run("roles can be listed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeRole("first", map[string]interface{}{}, t, b, storage)
+		storeRole("second", map[string]interface{}{}, t, b, storage)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ListOperation,
+			Path:      "roles/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := resp.Data["keys"].([]string)
+		if len(keys) != 2 || keys[0] != "first" || keys[1] != "second" {
+			t.Error("Unexpected roles:", keys)
+		}
+	})
+
+	t.Run("role can be deleted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeRole("test", map[string]interface{}{}, t, b, storage)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.DeleteOperation,
+			Path:      "roles/test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp := requestRole("test", t, b, storage); resp != nil {
+			t.Error("Role was not deleted:", resp)
+		}
+	})
+}
+
+func requestRole(name string, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "roles/" + name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func storeRole(name string, role map[string]interface{}, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	response, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "roles/" + name,
+		Data:      role,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
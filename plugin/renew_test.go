@@ -0,0 +1,188 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenew(t *testing.T) {
+	t.Run("renewal uses the current ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		credentials := requestCredentials(t, b, storage)
+		storeConfig(map[string]interface{}{"ttl": "2h"}, t, b, storage)
+
+		resp := renewSecret(credentials.Secret, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Renewal failed:", resp.Error())
+		}
+		if resp.Secret.TTL != 2*time.Hour {
+			t.Error("Renewed ttl should be", 2*time.Hour, "but is", resp.Secret.TTL)
+		}
+	})
+
+	t.Run("renewal is capped at max_ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key": "apiKey123",
+			"domain":  "example.com",
+			"ttl":     "1h",
+			"max_ttl": "2h",
+		}, t, b, storage)
+		credentials := requestCredentials(t, b, storage)
+		credentials.Secret.IssueTime = time.Now().Add(-90 * time.Minute)
+
+		resp := renewSecret(credentials.Secret, t, b, storage)
+
+		if resp.Secret.TTL > 30*time.Minute {
+			t.Error("Renewed ttl should be capped at 30m but is", resp.Secret.TTL)
+		}
+	})
+
+	t.Run("renewal fails if login was deleted in mailgun", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		credentials := requestCredentials(t, b, storage)
+		login := strings.TrimSuffix(credentials.Data["username"].(string), "@example.com")
+		testClient(b).DeleteCredential(login)
+
+		resp := renewSecret(credentials.Secret, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("Renewal of deleted login was successful")
+		}
+	})
+
+	t.Run("renewal uses the current role ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("test", map[string]interface{}{"ttl": "1h"}, t, b, storage)
+		credentials := requestRoleCredentials("test", nil, t, b, storage)
+		storeRole("test", map[string]interface{}{"ttl": "3h"}, t, b, storage)
+
+		resp := renewSecret(credentials.Secret, t, b, storage)
+
+		if resp.Secret.TTL != 3*time.Hour {
+			t.Error("Renewed ttl should be", 3*time.Hour, "but is", resp.Secret.TTL)
+		}
+	})
+
+	t.Run("renewal keeps the requested ttl", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key": "apiKey123",
+			"domain":  "example.com",
+			"ttl":     "2h",
+		}, t, b, storage)
+		credentials := writeCredentials(map[string]interface{}{"ttl": "30m"}, t, b, storage)
+
+		resp := renewSecret(credentials.Secret, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Renewal failed:", resp.Error())
+		}
+		if resp.Secret.TTL != 30*time.Minute {
+			t.Error("Renewed ttl should be", 30*time.Minute, "but is", resp.Secret.TTL)
+		}
+	})
+
+	t.Run("renewals share the list of logins", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		first := requestCredentials(t, b, storage)
+		second := requestCredentials(t, b, storage)
+
+		renewSecret(first.Secret, t, b, storage)
+		renewSecret(second.Secret, t, b, storage)
+		renewSecret(first.Secret, t, b, storage)
+
+		if requests := testClient(b).credentialRequests; requests != 1 {
+			t.Error("Expected 1 request of the logins, but was", requests)
+		}
+	})
+
+	t.Run("renewal of a mailing list fails if it was deleted in mailgun", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		storeRole("loadtest", map[string]interface{}{
+			"credential_type": credentialTypeMailingList,
+		}, t, b, storage)
+		list := requestRoleCredentials("loadtest", nil, t, b, storage)
+		testClient(b).DeleteList(list.Data["address"].(string))
+
+		if resp := renewSecret(list.Secret, t, b, storage); !resp.IsError() {
+			t.Error("Renewal of deleted mailing list was successful")
+		}
+	})
+
+	t.Run("renewal of a checked in library login fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+		libraryRequest("check-in", map[string]interface{}{
+			"username":     checkedOut.Data["username"],
+			"check_out_id": checkedOut.Data["check_out_id"],
+		}, t, b, storage)
+
+		if resp := renewSecret(checkedOut.Secret, t, b, storage); !resp.IsError() {
+			t.Error("Renewal of checked in login was successful")
+		}
+	})
+
+	t.Run("renewal of a library login fails if it was deleted in mailgun", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testLibraryBackend(t, "0")
+		checkedOut := libraryRequest("check-out", nil, t, b, storage)
+		testClient(b).DeleteCredential(strings.TrimSuffix(checkedOut.Data["username"].(string), "@example.com"))
+
+		if resp := renewSecret(checkedOut.Secret, t, b, storage); !resp.IsError() {
+			t.Error("Renewal of deleted login was successful")
+		}
+	})
+
+	t.Run("ttl greater than max_ttl is not allowed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		configResp := storeConfig(map[string]interface{}{
+			"api_key": "apiKey123",
+			"domain":  "example.com",
+			"ttl":     "2h",
+			"max_ttl": "1h",
+		}, t, b, storage)
+		roleResp := storeRole("test", map[string]interface{}{
+			"ttl":     "2h",
+			"max_ttl": "1h",
+		}, t, b, storage)
+
+		if !configResp.IsError() {
+			t.Error("Saving config with ttl > max_ttl was successful")
+		}
+		if !roleResp.IsError() {
+			t.Error("Saving role with ttl > max_ttl was successful")
+		}
+	})
+}
+
+func renewSecret(secret *logical.Secret, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.RenewOperation,
+		Secret:    secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,48 @@
+package mgsecret
+
+import (
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+)
+
+// errorResponses describe the errors shared by the operations.
+var errorResponses = map[int]framework.Response{
+	http.StatusBadRequest: {
+		Description: "The request is invalid, the plugin is not configured or Mailgun rejected the request. The errors explain why.",
+	},
+	http.StatusNotFound: {
+		Description: "The requested entry does not exist.",
+	},
+	http.StatusInternalServerError: {
+		Description: "Reading or writing the storage failed.",
+	},
+}
+
+// operationResponses returns the responses of an operation that answers
+// with code and the example data on success, or with one of the error codes.
+// Internal errors are always included.
+func operationResponses(code int, description string, example map[string]interface{}, errorCodes ...int) map[int][]framework.Response {
+	success := framework.Response{Description: description}
+	if example != nil {
+		success.Example = &logical.Response{Data: example}
+	}
+	responses := map[int][]framework.Response{
+		code: {success},
+	}
+	for _, errorCode := range append(errorCodes, http.StatusInternalServerError) {
+		responses[errorCode] = []framework.Response{errorResponses[errorCode]}
+	}
+	return responses
+}
+
+// noContentResponses returns the responses of an operation that answers
+// without data on success.
+func noContentResponses(description string, errorCodes ...int) map[int][]framework.Response {
+	return operationResponses(http.StatusNoContent, description, nil, errorCodes...)
+}
+
+// listExample returns the example data of a list operation.
+func listExample(keys ...string) map[string]interface{} {
+	return logical.ListResponse(keys).Data
+}
@@ -0,0 +1,83 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+)
+
+// Versions of the storage schema. Entries written before the schema was
+// versioned have version 0.
+const (
+	schemaVersionUnversioned = 0
+	// schemaVersionDefaultRole moved the settings of the "credentials" path
+	// into the "default" role.
+	schemaVersionDefaultRole = 1
+
+	currentSchemaVersion = schemaVersionDefaultRole
+	defaultRoleName      = "default"
+)
+
+// upgradeConfig upgrades a config read from storage to the current schema
+// version and stores the result. It returns whether cfg was changed.
+func upgradeConfig(ctx context.Context, s logical.Storage, cfg *config) (bool, error) {
+	if cfg.SchemaVersion > currentSchemaVersion {
+		return false, fmt.Errorf("config has schema version %d, but this plugin only supports up to %d", cfg.SchemaVersion, currentSchemaVersion)
+	}
+	if cfg.SchemaVersion == currentSchemaVersion {
+		return false, nil
+	}
+
+	if cfg.SchemaVersion < schemaVersionDefaultRole {
+		// Existing consumers of "credentials" keep getting the same
+		// credentials through the "default" role.
+		existing, err := getRole(ctx, s, defaultRoleName)
+		if err != nil {
+			return false, err
+		}
+		if existing == nil {
+			if err := putRole(ctx, s, defaultRoleName, newRole()); err != nil && err != logical.ErrReadOnly {
+				return false, err
+			}
+		}
+	}
+
+	cfg.SchemaVersion = currentSchemaVersion
+	entry, err := logical.StorageEntryJSON("config", cfg)
+	if err != nil {
+		return false, err
+	}
+	// Standbys cannot write, they use the upgraded config until the active
+	// node stored it.
+	if err := s.Put(ctx, entry); err != nil && err != logical.ErrReadOnly {
+		return false, err
+	}
+	return true, nil
+}
+
+// upgradeRole upgrades a role read from storage to the current schema version.
+// Roles are stored again on their next write.
+func upgradeRole(r *role) error {
+	if r.SchemaVersion > currentSchemaVersion {
+		return fmt.Errorf("role has schema version %d, but this plugin only supports up to %d", r.SchemaVersion, currentSchemaVersion)
+	}
+
+	if r.SchemaVersion < schemaVersionDefaultRole {
+		if r.CredentialType == "" {
+			r.CredentialType = credentialTypeSmtp
+		}
+		if r.ListAddressTemplate == "" {
+			r.ListAddressTemplate = defaultListAddressTemplate
+		}
+		if r.ListAccessLevel == "" {
+			r.ListAccessLevel = mailgun.ReadOnly
+		}
+		if r.VerifySmtpTimeout == 0 {
+			r.VerifySmtpTimeout = defaultSmtpVerifyTimeout
+		}
+	}
+
+	r.SchemaVersion = currentSchemaVersion
+	return nil
+}
@@ -0,0 +1,119 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"testing"
+	"time"
+)
+
+func TestSchemaUpgrade(t *testing.T) {
+	t.Run("unversioned config gets a default role", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		putRawEntry("config", `{"ApiKey":"key","Domain":"example.com","TTL":3600000000000}`, t, storage)
+
+		if r, _ := getRole(context.Background(), storage, defaultRoleName); r != nil {
+			t.Fatal("default role should not exist before the config is read")
+		}
+		requestConfig(t, b, storage)
+
+		resp := requestRole(defaultRoleName, t, b, storage)
+		if resp == nil {
+			t.Fatal("default role was not created")
+		}
+		if credentialType := resp.Data["credential_type"]; credentialType != credentialTypeSmtp {
+			t.Error("credential_type should be", credentialTypeSmtp, "but is", credentialType)
+		}
+		cfg, err := getConfig(context.Background(), storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.SchemaVersion != currentSchemaVersion {
+			t.Error("schema version should be", currentSchemaVersion, "but is", cfg.SchemaVersion)
+		}
+		if cfg.Version != 0 {
+			t.Error("upgrade should not create a config version, but version is", cfg.Version)
+		}
+	})
+
+	t.Run("credentials of upgraded mount use the default role", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		putRawEntry("config", `{"ApiKey":"key","Domain":"example.com","TTL":3600000000000}`, t, storage)
+
+		resp := requestCredentials(t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Unexpected error:", resp.Error())
+		}
+		if roleName := resp.Secret.InternalData[internalDataRole]; roleName != defaultRoleName {
+			t.Error("role should be", defaultRoleName, "but is", roleName)
+		}
+		if resp.Secret.TTL != time.Hour {
+			t.Error("Credential ttl should be", time.Hour, "but is", resp.Secret.TTL)
+		}
+	})
+
+	t.Run("existing default role is kept", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		putRawEntry(rolesStoragePrefix+defaultRoleName, `{"CredentialType":"mailing_list"}`, t, storage)
+		putRawEntry("config", `{"ApiKey":"key","Domain":"example.com"}`, t, storage)
+
+		requestConfig(t, b, storage)
+
+		resp := requestRole(defaultRoleName, t, b, storage)
+		if credentialType := resp.Data["credential_type"]; credentialType != credentialTypeMailingList {
+			t.Error("credential_type should be", credentialTypeMailingList, "but is", credentialType)
+		}
+	})
+
+	t.Run("new mounts do not get a default role", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		if resp := requestRole(defaultRoleName, t, b, storage); resp != nil {
+			t.Error("Unexpected default role:", resp.Data)
+		}
+	})
+
+	t.Run("unversioned role gets defaults", func(t *testing.T) {
+		t.Parallel()
+		_, storage := testBackend(t)
+		putRawEntry(rolesStoragePrefix+"old", `{"CredentialType":"mailing_list"}`, t, storage)
+
+		r, err := getRole(context.Background(), storage, "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ListAccessLevel != mailgun.ReadOnly {
+			t.Error("list access level should be", mailgun.ReadOnly, "but is", r.ListAccessLevel)
+		}
+		if r.ListAddressTemplate != defaultListAddressTemplate {
+			t.Error("list address template should be", defaultListAddressTemplate, "but is", r.ListAddressTemplate)
+		}
+		if r.VerifySmtpTimeout != defaultSmtpVerifyTimeout {
+			t.Error("verify timeout should be", defaultSmtpVerifyTimeout, "but is", r.VerifySmtpTimeout)
+		}
+	})
+
+	t.Run("newer schema version is rejected", func(t *testing.T) {
+		t.Parallel()
+		_, storage := testBackend(t)
+		putRawEntry("config", `{"SchemaVersion":99,"ApiKey":"key","Domain":"example.com"}`, t, storage)
+
+		if _, err := getConfig(context.Background(), storage); err == nil {
+			t.Error("config with a newer schema version should not be read")
+		}
+	})
+}
+
+func putRawEntry(key, value string, t *testing.T, storage logical.Storage) {
+	t.Helper()
+	if err := storage.Put(context.Background(), &logical.StorageEntry{Key: key, Value: []byte(value)}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"net/http"
+)
+
+func pathConfigPromote(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/promote",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.pathConfigPromote,
+				Summary:   "Make the secondary API key the primary API key.",
+				Responses: noContentResponses("The secondary API key is the primary API key.", http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathConfigPromoteHelpSyn,
+		HelpDescription: pathConfigPromoteHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathConfigPromote(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, cfg); !ok {
+		return response, err
+	}
+	if cfg.SecondaryApiKey == "" {
+		return logical.ErrorResponse("No 'secondary_api_key' is configured."), nil
+	}
+
+	cfg.ApiKey = cfg.SecondaryApiKey
+	cfg.SecondaryApiKey = ""
+	if resp := b.validateConfig(cfg); resp != nil {
+		return resp, nil
+	}
+	return nil, b.putConfig(ctx, req, cfg, 0)
+}
+
+// withSecondaryApiKey makes the client repeat requests that were rejected as
+// unauthorized with the secondary API key.
+func withSecondaryApiKey(client MailgunClient, secondaryApiKey string) {
+	wrapTransport(client, func(base http.RoundTripper) http.RoundTripper {
+		return &secondaryApiKeyTransport{
+			base:            base,
+			secondaryApiKey: secondaryApiKey,
+		}
+	})
+}
+
+// secondaryApiKeyTransport repeats requests with the secondary API key if the
+// primary API key is rejected.
+type secondaryApiKeyTransport struct {
+	base            http.RoundTripper
+	secondaryApiKey string
+}
+
+func (t *secondaryApiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport().RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// Requests with a body can only be repeated if the body can be read again.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	retry := new(http.Request)
+	*retry = *req
+	retry.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		retry.Header[key] = values
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	user, _, _ := req.BasicAuth()
+	retry.SetBasicAuth(user, t.secondaryApiKey)
+
+	resp.Body.Close()
+	return t.transport().RoundTrip(retry)
+}
+
+func (t *secondaryApiKeyTransport) transport() http.RoundTripper {
+	return baseTransport(t.base)
+}
+
+const pathConfigPromoteHelpSyn = `
+Promote the secondary API key.
+`
+
+const pathConfigPromoteHelpDesc = `
+Makes the configured "secondary_api_key" the primary API key and removes the
+secondary API key. The key is validated against the Mailgun API first.
+
+While a secondary API key is configured, every Mailgun API request that is
+rejected as unauthorized with the primary API key is repeated with the
+secondary API key. This allows to replace the key in the Mailgun dashboard
+before the config is updated.
+`
@@ -0,0 +1,146 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestSecondaryApiKey(t *testing.T) {
+	t.Run("secondary api key is used if primary is rejected", func(t *testing.T) {
+		t.Parallel()
+		server, logins := startMailgunStandIn("secondary")
+		defer server.Close()
+
+		client := DefaultMailgunClientFactory("example.com", "primary")
+		client.(apiBaseSetter).SetAPIBase(server.URL)
+		withSecondaryApiKey(client, "secondary")
+
+		if !client.IsApiKeyValid() {
+			t.Error("secondary api key was not used")
+		}
+		if err := client.CreateCredential("test", "password123"); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if got := logins(); len(got) != 1 || got[0] != "test" {
+			t.Error("request body was not repeated, created logins are", got)
+		}
+	})
+
+	t.Run("without secondary api key the request is rejected", func(t *testing.T) {
+		t.Parallel()
+		server, _ := startMailgunStandIn("secondary")
+		defer server.Close()
+
+		client := DefaultMailgunClientFactory("example.com", "primary")
+		client.(apiBaseSetter).SetAPIBase(server.URL)
+
+		if client.IsApiKeyValid() {
+			t.Error("primary api key should be rejected")
+		}
+	})
+
+	t.Run("invalid secondary api key is not saved", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		valid := b.MailgunFactory
+		b.MailgunFactory = func(domain, apiKey string) MailgunClient {
+			if apiKey == "invalid" {
+				return newTestMailgunClient(true, false)
+			}
+			return valid(domain, apiKey)
+		}
+		storeDefaultConfig(t, b, storage)
+
+		resp := storeConfig(map[string]interface{}{"secondary_api_key": "invalid"}, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("invalid secondary_api_key was saved")
+		}
+	})
+
+	t.Run("promote makes secondary api key primary", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeConfig(map[string]interface{}{
+			"api_key":           "primary-key-1234",
+			"secondary_api_key": "secondary-key-5678",
+			"domain":            "example.com",
+		}, t, b, storage)
+		if fingerprint := requestConfig(t, b, storage).Data["secondary_api_key_fingerprint"]; fingerprint == "" {
+			t.Fatal("secondary_api_key_fingerprint should be set")
+		}
+
+		resp := promoteApiKey(t, b, storage)
+
+		if resp != nil && resp.IsError() {
+			t.Fatal("Unexpected error:", resp.Error())
+		}
+		cfg, err := getConfig(context.Background(), storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ApiKey != "secondary-key-5678" {
+			t.Error("api key should be the secondary api key but is", cfg.ApiKey)
+		}
+		data := requestConfig(t, b, storage).Data
+		if fingerprint := data["secondary_api_key_fingerprint"]; fingerprint != "" {
+			t.Error("secondary_api_key_fingerprint should be empty but is", fingerprint)
+		}
+		if version := data["version"]; version != 2 {
+			t.Error("promote should create version 2 but version is", version)
+		}
+	})
+
+	t.Run("promote without secondary api key fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		resp := promoteApiKey(t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("promote without secondary_api_key should fail")
+		}
+	})
+}
+
+// startMailgunStandIn starts an HTTP server that only accepts the given API
+// key. It returns the logins of the created credentials.
+func startMailgunStandIn(apiKey string) (*httptest.Server, func() []string) {
+	var lock sync.Mutex
+	var logins []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, _ := r.BasicAuth(); password != apiKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost {
+			lock.Lock()
+			logins = append(logins, r.FormValue("login"))
+			lock.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"total_count": 0, "items": []}`))
+	}))
+	return server, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), logins...)
+	}
+}
+
+func promoteApiKey(t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "config/promote",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,118 @@
+package mgsecret
+
+import (
+	"fmt"
+	"github.com/hashicorp/vault/logical/framework"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const (
+	regionUS = "us"
+	regionEU = "eu"
+
+	smtpTlsStartTls = "starttls"
+	smtpTlsImplicit = "tls"
+
+	outputFormatSmtpUri           = "smtp_uri"
+	outputFormatPostfixSaslPasswd = "postfix_sasl_passwd"
+)
+
+var (
+	regions       = []string{regionUS, regionEU}
+	outputFormats = []string{outputFormatSmtpUri, outputFormatPostfixSaslPasswd}
+
+	regionApiBase = map[string]string{
+		regionUS: "https://api.mailgun.net/v3",
+		regionEU: "https://api.eu.mailgun.net/v3",
+	}
+	regionSmtpHost = map[string]string{
+		regionUS: defaultSmtpHost,
+		regionEU: "smtp.eu.mailgun.org",
+	}
+
+	// smtpPorts are the ports offered by the Mailgun SMTP servers of all regions.
+	smtpPorts = map[string][]int{
+		smtpTlsStartTls: {25, 587, 2525},
+		smtpTlsImplicit: {smtpImplicitTlsPort},
+	}
+)
+
+// smtpTlsMode returns how TLS is negotiated on the given Mailgun SMTP port.
+func smtpTlsMode(port int) string {
+	if port == smtpImplicitTlsPort {
+		return smtpTlsImplicit
+	}
+	return smtpTlsStartTls
+}
+
+// smtpCredentialFields describes the data of the secrets with an SMTP
+// credential, as returned by smtpConnectionData.
+func smtpCredentialFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"username": {
+			Type:        framework.TypeString,
+			Description: "The SMTP username for mailgun.",
+		},
+		"password": {
+			Type:        framework.TypeString,
+			Description: "The SMTP password for mailgun.",
+		},
+		"smtp_host": {
+			Type:        framework.TypeString,
+			Description: "The SMTP host to send with.",
+		},
+		"smtp_port": {
+			Type:        framework.TypeInt,
+			Description: "The SMTP port to send with.",
+		},
+		"smtp_tls": {
+			Type:        framework.TypeString,
+			Description: fmt.Sprintf("How TLS is negotiated on smtp_port. One of %v.", []string{smtpTlsStartTls, smtpTlsImplicit}),
+		},
+		"smtp_ports": {
+			Type:        framework.TypeMap,
+			Description: "The ports offered by the Mailgun SMTP servers per TLS mode.",
+		},
+		outputFormatSmtpUri: {
+			Type:        framework.TypeString,
+			Description: "The credential as SMTP URI. Only returned if requested with the output_formats of the role.",
+		},
+		outputFormatPostfixSaslPasswd: {
+			Type:        framework.TypeString,
+			Description: "The credential as line of a Postfix sasl_passwd file. Only returned if requested with the output_formats of the role.",
+		},
+	}
+}
+
+// smtpConnectionData returns the SMTP connection details for a credential
+// together with the requested additional output formats.
+func smtpConnectionData(config *config, username, password string, formats []string) map[string]interface{} {
+	host, port := config.smtpHost(), config.smtpPort()
+	data := map[string]interface{}{
+		"smtp_host":  host,
+		"smtp_port":  port,
+		"smtp_tls":   smtpTlsMode(port),
+		"smtp_ports": smtpPorts,
+	}
+
+	for _, format := range formats {
+		switch format {
+		case outputFormatSmtpUri:
+			scheme := "smtp"
+			if smtpTlsMode(port) == smtpTlsImplicit {
+				scheme = "smtps"
+			}
+			uri := url.URL{
+				Scheme: scheme,
+				User:   url.UserPassword(username, password),
+				Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+			}
+			data[outputFormatSmtpUri] = uri.String()
+		case outputFormatPostfixSaslPasswd:
+			data[outputFormatPostfixSaslPasswd] = fmt.Sprintf("[%s]:%d %s:%s\n", host, port, username, password)
+		}
+	}
+	return data
+}
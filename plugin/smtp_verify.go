@@ -0,0 +1,81 @@
+package mgsecret
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSmtpHost          = "smtp.mailgun.org"
+	defaultSmtpPort          = 587
+	defaultSmtpVerifyTimeout = 30 * time.Second
+	smtpImplicitTlsPort      = 465
+)
+
+// SmtpVerifier checks whether the SMTP server at host and port accepts the
+// given credential.
+type SmtpVerifier func(ctx context.Context, host string, port int, username, password string) error
+
+// DefaultSmtpVerifier authenticates with SMTP AUTH PLAIN. Port 465 uses
+// implicit TLS, all other ports use STARTTLS if the server offers it.
+func DefaultSmtpVerifier(ctx context.Context, host string, port int, username, password string) error {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	// The deadline of ctx also bounds the TLS handshake and the SMTP dialog.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if port == smtpImplicitTlsPort {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := client.Auth(smtp.PlainAuth("", username, password, host)); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// waitForSmtpAuth retries the SMTP authentication until it succeeds or the
+// timeout is reached. It returns the last authentication error on timeout.
+func (b *mailgunBackend) waitForSmtpAuth(ctx context.Context, config *config, timeout time.Duration, username, password string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		err := b.SmtpVerifier(ctx, config.smtpHost(), config.smtpPort(), username, password)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("SMTP server %s:%d did not accept the credential within %s: %v", config.smtpHost(), config.smtpPort(), timeout, err)
+		case <-time.After(b.smtpVerifyInterval):
+		}
+	}
+}
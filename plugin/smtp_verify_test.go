@@ -0,0 +1,136 @@
+package mgsecret
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSmtpVerify(t *testing.T) {
+	t.Run("verifier authenticates against smtp server", func(t *testing.T) {
+		t.Parallel()
+		listener, port, _ := startSmtpStandIn(t, 0)
+		defer listener.Close()
+
+		err := DefaultSmtpVerifier(context.Background(), "127.0.0.1", port, "user@example.com", "secret")
+
+		if err != nil {
+			t.Error("Verification failed:", err)
+		}
+	})
+
+	t.Run("verifier fails on rejected credential", func(t *testing.T) {
+		t.Parallel()
+		listener, port, _ := startSmtpStandIn(t, 1)
+		defer listener.Close()
+
+		err := DefaultSmtpVerifier(context.Background(), "127.0.0.1", port, "user@example.com", "secret")
+
+		if err == nil {
+			t.Error("Verification of rejected credential was successful")
+		}
+	})
+
+	t.Run("credential is returned once smtp server accepts it", func(t *testing.T) {
+		t.Parallel()
+		listener, port, attempts := startSmtpStandIn(t, 2)
+		defer listener.Close()
+		b, storage := testSmtpVerifyBackend(t, port, "10s")
+
+		resp := requestRoleCredentials("verified", nil, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Verified credential is an error but should not:", resp.Error())
+		}
+		if n := atomic.LoadInt32(attempts); n != 3 {
+			t.Error("Expected 3 authentication attempts, but were", n)
+		}
+	})
+
+	t.Run("credential is deleted if smtp server never accepts it", func(t *testing.T) {
+		t.Parallel()
+		listener, port, _ := startSmtpStandIn(t, 1000)
+		defer listener.Close()
+		b, storage := testSmtpVerifyBackend(t, port, "1s")
+
+		resp := requestRoleCredentials("verified", nil, t, b, storage)
+
+		if !resp.IsError() {
+			t.Error("Unverified credential was returned:", resp.Data)
+		}
+		if len(testClient(b).credentials) != 0 {
+			t.Error("Unverified credential was not deleted:", testClient(b).credentials)
+		}
+	})
+}
+
+func testSmtpVerifyBackend(t *testing.T, port int, timeout string) (*mailgunBackend, logical.Storage) {
+	b, storage := testBackend(t)
+	b.smtpVerifyInterval = 10 * time.Millisecond
+	storeConfig(map[string]interface{}{
+		"api_key":   "apiKey123",
+		"domain":    "example.com",
+		"smtp_host": "127.0.0.1",
+		"smtp_port": port,
+	}, t, b, storage)
+	storeRole("verified", map[string]interface{}{
+		"verify_smtp":         true,
+		"verify_smtp_timeout": timeout,
+	}, t, b, storage)
+	return b, storage
+}
+
+// startSmtpStandIn starts a minimal SMTP server on localhost which rejects
+// the first rejections AUTH attempts and accepts all following ones.
+func startSmtpStandIn(t *testing.T, rejections int32) (net.Listener, int, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSmtp(conn, rejections, &attempts)
+		}
+	}()
+	return listener, listener.Addr().(*net.TCPAddr).Port, &attempts
+}
+
+func serveSmtp(conn net.Conn, rejections int32, attempts *int32) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP stand-in\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			fmt.Fprint(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+		case strings.HasPrefix(command, "AUTH PLAIN"):
+			if atomic.AddInt32(attempts, 1) <= rejections {
+				fmt.Fprint(conn, "535 5.7.8 Authentication failed\r\n")
+			} else {
+				fmt.Fprint(conn, "235 2.7.0 Authentication successful\r\n")
+			}
+		case strings.HasPrefix(command, "QUIT"):
+			fmt.Fprint(conn, "221 Bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 OK\r\n")
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package mgsecret
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	suppressionListBounces      = "bounces"
+	suppressionListUnsubscribes = "unsubscribes"
+	suppressionListComplaints   = "complaints"
+
+	defaultSuppressionLimit = 100
+	maxSuppressionLimit     = 1000
+	// defaultBounceCode is the SMTP code of bounces added without code.
+	defaultBounceCode = "550"
+	// unsubscribeAllTag unsubscribes an address from all messages.
+	unsubscribeAllTag = "*"
+)
+
+// escapeAddress escapes an address for the URL path of a Mailgun API call.
+// The client does not escape it and Mailgun decodes '+' as a space.
+func escapeAddress(address string) string {
+	return strings.Replace(url.PathEscape(address), "+", "%2B", -1)
+}
+
+// suppressionList accesses one of the suppression lists of the domain.
+// Entries are returned as response data.
+type suppressionList struct {
+	list   func(client MailgunClient, limit, skip int) ([]map[string]interface{}, error)
+	read   func(client MailgunClient, address string) (map[string]interface{}, error)
+	add    func(client MailgunClient, address string, data *framework.FieldData) error
+	remove func(client MailgunClient, address string) error
+}
+
+var suppressionLists = map[string]suppressionList{
+	suppressionListBounces: {
+		list: func(client MailgunClient, limit, skip int) ([]map[string]interface{}, error) {
+			_, bounces, err := client.GetBounces(limit, skip)
+			entries := make([]map[string]interface{}, len(bounces))
+			for i, bounce := range bounces {
+				entries[i] = bounceData(bounce)
+			}
+			return entries, err
+		},
+		read: func(client MailgunClient, address string) (map[string]interface{}, error) {
+			bounce, err := client.GetSingleBounce(escapeAddress(address))
+			return bounceData(bounce), err
+		},
+		add: func(client MailgunClient, address string, data *framework.FieldData) error {
+			return client.AddBounce(address, data.Get("code").(string), data.Get("error").(string))
+		},
+		remove: func(client MailgunClient, address string) error {
+			return client.DeleteBounce(escapeAddress(address))
+		},
+	},
+	suppressionListUnsubscribes: {
+		list: func(client MailgunClient, limit, skip int) ([]map[string]interface{}, error) {
+			_, unsubscribes, err := client.GetUnsubscribes(limit, skip)
+			entries := make([]map[string]interface{}, len(unsubscribes))
+			for i, unsubscribe := range unsubscribes {
+				entries[i] = unsubscribeData(unsubscribe)
+			}
+			return entries, err
+		},
+		read: func(client MailgunClient, address string) (map[string]interface{}, error) {
+			_, unsubscribes, err := client.GetUnsubscribesByAddress(escapeAddress(address))
+			if err != nil || len(unsubscribes) == 0 {
+				return nil, err
+			}
+			// Mailgun returns an entry per tag.
+			data := unsubscribeData(unsubscribes[0])
+			tags := []string{}
+			for _, unsubscribe := range unsubscribes {
+				tags = append(tags, unsubscribe.Tags...)
+			}
+			data["tags"] = tags
+			return data, nil
+		},
+		add: func(client MailgunClient, address string, data *framework.FieldData) error {
+			return client.Unsubscribe(address, data.Get("tag").(string))
+		},
+		remove: func(client MailgunClient, address string) error {
+			return client.RemoveUnsubscribe(escapeAddress(address))
+		},
+	},
+	suppressionListComplaints: {
+		list: func(client MailgunClient, limit, skip int) ([]map[string]interface{}, error) {
+			_, complaints, err := client.GetComplaints(limit, skip)
+			entries := make([]map[string]interface{}, len(complaints))
+			for i, complaint := range complaints {
+				entries[i] = complaintData(complaint)
+			}
+			return entries, err
+		},
+		read: func(client MailgunClient, address string) (map[string]interface{}, error) {
+			complaint, err := client.GetSingleComplaint(escapeAddress(address))
+			return complaintData(complaint), err
+		},
+		add: func(client MailgunClient, address string, data *framework.FieldData) error {
+			return client.CreateComplaint(address)
+		},
+		remove: func(client MailgunClient, address string) error {
+			return client.DeleteComplaint(escapeAddress(address))
+		},
+	},
+}
+
+func bounceData(bounce mailgun.Bounce) map[string]interface{} {
+	code := ""
+	if bounce.Code != nil {
+		code = fmt.Sprint(bounce.Code)
+	}
+	return map[string]interface{}{
+		"address":    bounce.Address,
+		"code":       code,
+		"error":      bounce.Error,
+		"created_at": bounce.CreatedAt,
+	}
+}
+
+func unsubscribeData(unsubscribe mailgun.Unsubscription) map[string]interface{} {
+	return map[string]interface{}{
+		"address":    unsubscribe.Address,
+		"tags":       unsubscribe.Tags,
+		"created_at": unsubscribe.CreatedAt,
+	}
+}
+
+func complaintData(complaint mailgun.Complaint) map[string]interface{} {
+	return map[string]interface{}{
+		"address":    complaint.Address,
+		"count":      complaint.Count,
+		"created_at": complaint.CreatedAt,
+	}
+}
+
+func (c healthTrackingClient) GetBounces(limit, skip int) (int, []mailgun.Bounce, error) {
+	var total int
+	var bounces []mailgun.Bounce
+	err := c.call(func() (err error) {
+		total, bounces, err = c.client.GetBounces(limit, skip)
+		return err
+	})
+	return total, bounces, err
+}
+
+func (c healthTrackingClient) GetSingleBounce(address string) (mailgun.Bounce, error) {
+	var bounce mailgun.Bounce
+	err := c.call(func() (err error) {
+		bounce, err = c.client.GetSingleBounce(address)
+		return err
+	})
+	return bounce, err
+}
+
+func (c healthTrackingClient) AddBounce(address, code, message string) error {
+	return c.call(func() error {
+		return c.client.AddBounce(address, code, message)
+	})
+}
+
+func (c healthTrackingClient) DeleteBounce(address string) error {
+	return c.call(func() error {
+		return c.client.DeleteBounce(address)
+	})
+}
+
+func (c healthTrackingClient) GetUnsubscribes(limit, skip int) (int, []mailgun.Unsubscription, error) {
+	var total int
+	var unsubscribes []mailgun.Unsubscription
+	err := c.call(func() (err error) {
+		total, unsubscribes, err = c.client.GetUnsubscribes(limit, skip)
+		return err
+	})
+	return total, unsubscribes, err
+}
+
+func (c healthTrackingClient) GetUnsubscribesByAddress(address string) (int, []mailgun.Unsubscription, error) {
+	var total int
+	var unsubscribes []mailgun.Unsubscription
+	err := c.call(func() (err error) {
+		total, unsubscribes, err = c.client.GetUnsubscribesByAddress(address)
+		return err
+	})
+	return total, unsubscribes, err
+}
+
+func (c healthTrackingClient) Unsubscribe(address, tag string) error {
+	return c.call(func() error {
+		return c.client.Unsubscribe(address, tag)
+	})
+}
+
+func (c healthTrackingClient) RemoveUnsubscribe(address string) error {
+	return c.call(func() error {
+		return c.client.RemoveUnsubscribe(address)
+	})
+}
+
+func (c healthTrackingClient) GetComplaints(limit, skip int) (int, []mailgun.Complaint, error) {
+	var total int
+	var complaints []mailgun.Complaint
+	err := c.call(func() (err error) {
+		total, complaints, err = c.client.GetComplaints(limit, skip)
+		return err
+	})
+	return total, complaints, err
+}
+
+func (c healthTrackingClient) GetSingleComplaint(address string) (mailgun.Complaint, error) {
+	var complaint mailgun.Complaint
+	err := c.call(func() (err error) {
+		complaint, err = c.client.GetSingleComplaint(address)
+		return err
+	})
+	return complaint, err
+}
+
+func (c healthTrackingClient) CreateComplaint(address string) error {
+	return c.call(func() error {
+		return c.client.CreateComplaint(address)
+	})
+}
+
+func (c healthTrackingClient) DeleteComplaint(address string) error {
+	return c.call(func() error {
+		return c.client.DeleteComplaint(address)
+	})
+}
+
+var suppressionListNames = []string{suppressionListBounces, suppressionListUnsubscribes, suppressionListComplaints}
+
+func suppressionListPattern() string {
+	return "suppressions/(?P<list>" + strings.Join(suppressionListNames, "|") + ")"
+}
+
+func pathSuppressionList(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: suppressionListPattern() + "/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"list": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("Suppression list of the domain. One of %v.", suppressionListNames),
+			},
+			"limit": {
+				Type:        framework.TypeInt,
+				Description: fmt.Sprintf("Maximum number of entries to return, at most %d.", maxSuppressionLimit),
+				Default:     defaultSuppressionLimit,
+			},
+			"skip": {
+				Type:        framework.TypeInt,
+				Description: "Number of entries to skip, to return the entries after the first page.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathSuppressionList,
+				Summary:  "List the addresses on a suppression list of the domain.",
+				Responses: operationResponses(http.StatusOK, "The addresses with the details of their entries.", logical.ListResponseWithInfo([]string{"alice@example.org"}, map[string]interface{}{
+					"alice@example.org": map[string]interface{}{
+						"address":    "alice@example.org",
+						"code":       "550",
+						"error":      "No such mailbox",
+						"created_at": "Wed, 02 Jan 2019 15:04:05 UTC",
+					},
+				}).Data, http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathSuppressionsHelpSyn,
+		HelpDescription: pathSuppressionsHelpDesc,
+	}
+}
+
+func pathSuppression(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: suppressionListPattern() + "/(?P<address>[^/]+)$",
+		Fields: map[string]*framework.FieldSchema{
+			"list": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("Suppression list of the domain. One of %v.", suppressionListNames),
+			},
+			"address": {
+				Type:        framework.TypeString,
+				Description: "Email address on the suppression list.",
+			},
+			"code": {
+				Type:        framework.TypeString,
+				Description: "SMTP error code of an added bounce. Only used by bounces.",
+				Default:     defaultBounceCode,
+			},
+			"error": {
+				Type:        framework.TypeString,
+				Description: "Error message of an added bounce. Only used by bounces.",
+			},
+			"tag": {
+				Type:        framework.TypeString,
+				Description: "Tag of the messages an added address is unsubscribed from, * for all. Only used by unsubscribes.",
+				Default:     unsubscribeAllTag,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathSuppressionRead,
+				Summary:  "Return the entry of an address on a suppression list.",
+				Responses: operationResponses(http.StatusOK, "The entry. Bounces have code and error, unsubscribes tags and complaints count.", map[string]interface{}{
+					"address":    "alice@example.org",
+					"code":       "550",
+					"error":      "No such mailbox",
+					"created_at": "Wed, 02 Jan 2019 15:04:05 UTC",
+				}, http.StatusBadRequest, http.StatusNotFound),
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:  b.pathSuppressionWrite,
+				Summary:   "Add an address to a suppression list.",
+				Responses: noContentResponses("The address is on the suppression list.", http.StatusBadRequest),
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback:  b.pathSuppressionDelete,
+				Summary:   "Remove an address from a suppression list.",
+				Responses: noContentResponses("The address is not on the suppression list any longer.", http.StatusBadRequest),
+			},
+		},
+		HelpSynopsis:    pathSuppressionsHelpSyn,
+		HelpDescription: pathSuppressionsHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathSuppressionList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+	limit := data.Get("limit").(int)
+	if limit <= 0 || limit > maxSuppressionLimit {
+		return logical.ErrorResponse(fmt.Sprintf("'limit' must be between 1 and %d.", maxSuppressionLimit)), nil
+	}
+
+	skip := data.Get("skip").(int)
+	if skip < 0 {
+		return logical.ErrorResponse("'skip' must not be negative."), nil
+	}
+
+	listName := data.Get("list").(string)
+	entries, err := suppressionLists[listName].list(b.client(config), limit, skip)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to list %s in mailgun: %v", listName, err)), nil
+	}
+
+	keys := make([]string, 0, len(entries))
+	keyInfo := make(map[string]interface{}, len(entries))
+	for _, entry := range entries {
+		address := entry["address"].(string)
+		keys = append(keys, address)
+		keyInfo[address] = entry
+	}
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *mailgunBackend) pathSuppressionRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	listName, address := data.Get("list").(string), data.Get("address").(string)
+	entry, err := suppressionLists[listName].read(b.client(config), address)
+	if mailgun.GetStatusFromErr(err) == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to read %s in mailgun: %v", listName, err)), nil
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	return &logical.Response{Data: entry}, nil
+}
+
+func (b *mailgunBackend) pathSuppressionWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	listName, address := data.Get("list").(string), data.Get("address").(string)
+	if _, ok := data.GetOk("tag"); ok && listName != suppressionListUnsubscribes {
+		return logical.ErrorResponse("'tag' is only supported for unsubscribes."), nil
+	}
+	_, codeOk := data.GetOk("code")
+	_, errorOk := data.GetOk("error")
+	if (codeOk || errorOk) && listName != suppressionListBounces {
+		return logical.ErrorResponse("'code' and 'error' are only supported for bounces."), nil
+	}
+
+	if err := suppressionLists[listName].add(b.client(config), address, data); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to add %s to %s in mailgun: %v", address, listName, err)), nil
+	}
+	b.Logger().Info("added address to suppression list", "list", listName, "domain", config.Domain, "address", address, "request_id", req.ID, "display_name", req.DisplayName)
+	return nil, nil
+}
+
+func (b *mailgunBackend) pathSuppressionDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if ok, response, err := handleGetConfigErrors(err, config); !ok {
+		return response, err
+	}
+
+	listName, address := data.Get("list").(string), data.Get("address").(string)
+	err = suppressionLists[listName].remove(b.client(config), address)
+	// Removing an address that is not on the list succeeds.
+	if err != nil && mailgun.GetStatusFromErr(err) != http.StatusNotFound {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to remove %s from %s in mailgun: %v", address, listName, err)), nil
+	}
+	b.Logger().Info("removed address from suppression list", "list", listName, "domain", config.Domain, "address", address, "request_id", req.ID, "display_name", req.DisplayName)
+	return nil, nil
+}
+
+const pathSuppressionsHelpSyn = `
+Manage the suppression lists of the configured domain.
+`
+
+const pathSuppressionsHelpDesc = `
+Mailgun does not deliver messages to addresses on the suppression lists of
+the domain: "bounces", "unsubscribes" and "complaints". Listing
+"suppressions/<list>" returns up to "limit" addresses after the first "skip"
+ones. Reading, writing and deleting "suppressions/<list>/<address>" returns,
+adds and removes an address, without handing out the Mailgun API key.
+
+Bounces are added with "code" (default 550) and "error", unsubscribes with
+"tag" (default *, all messages). Removing an unsubscribed address removes it
+for all tags.
+`
@@ -0,0 +1,325 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPathSuppressions(t *testing.T) {
+	t.Run("bounces are listed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		testClient(b).bounces["alice@example.org"] = mailgun.Bounce{Address: "alice@example.org", Code: 550.0, Error: "No such mailbox"}
+
+		resp := suppressionRequest(logical.ListOperation, "bounces", nil, t, b, storage)
+
+		if resp.IsError() {
+			t.Fatal("Unexpected error:", resp.Error())
+		}
+		if keys := resp.Data["keys"].([]string); len(keys) != 1 || keys[0] != "alice@example.org" {
+			t.Error("Unexpected keys:", keys)
+		}
+		info := resp.Data["key_info"].(map[string]interface{})["alice@example.org"].(map[string]interface{})
+		if info["code"] != "550" || info["error"] != "No such mailbox" {
+			t.Error("Unexpected key_info:", info)
+		}
+	})
+
+	t.Run("bounce is added and removed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		suppressionRequest(logical.UpdateOperation, "bounces/alice@example.org", map[string]interface{}{"error": "No such mailbox"}, t, b, storage)
+
+		if bounce := testClient(b).bounces["alice@example.org"]; bounce.Code != defaultBounceCode || bounce.Error != "No such mailbox" {
+			t.Error("Unexpected bounce:", bounce)
+		}
+		resp := suppressionRequest(logical.ReadOperation, "bounces/alice@example.org", nil, t, b, storage)
+		if resp == nil || resp.Data["address"] != "alice@example.org" {
+			t.Error("Unexpected bounce:", resp)
+		}
+
+		suppressionRequest(logical.DeleteOperation, "bounces/alice@example.org", nil, t, b, storage)
+
+		if _, ok := testClient(b).bounces["alice@example.org"]; ok {
+			t.Error("bounce should be removed")
+		}
+	})
+
+	t.Run("unsubscribe is added with tag", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		suppressionRequest(logical.UpdateOperation, "unsubscribes/alice@example.org", map[string]interface{}{"tag": "newsletter"}, t, b, storage)
+		resp := suppressionRequest(logical.ReadOperation, "unsubscribes/alice@example.org", nil, t, b, storage)
+
+		if tags := resp.Data["tags"].([]string); len(tags) != 1 || tags[0] != "newsletter" {
+			t.Error("Unexpected tags:", tags)
+		}
+	})
+
+	t.Run("complaint is removed", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		testClient(b).complaints["alice@example.org"] = mailgun.Complaint{Address: "alice@example.org", Count: 2}
+
+		if resp := suppressionRequest(logical.ReadOperation, "complaints/alice@example.org", nil, t, b, storage); resp.Data["count"] != 2 {
+			t.Error("Unexpected complaint:", resp.Data)
+		}
+		suppressionRequest(logical.DeleteOperation, "complaints/alice@example.org", nil, t, b, storage)
+
+		if _, ok := testClient(b).complaints["alice@example.org"]; ok {
+			t.Error("complaint should be removed")
+		}
+	})
+
+	t.Run("unknown address is not found", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		if resp := suppressionRequest(logical.ReadOperation, "bounces/alice@example.org", nil, t, b, storage); resp != nil {
+			t.Error("Unexpected response:", resp)
+		}
+		if resp := suppressionRequest(logical.DeleteOperation, "bounces/alice@example.org", nil, t, b, storage); resp != nil {
+			t.Error("removing unknown address should succeed but got", resp)
+		}
+	})
+
+	t.Run("fields of other lists fail", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		if resp := suppressionRequest(logical.UpdateOperation, "complaints/alice@example.org", map[string]interface{}{"code": "550"}, t, b, storage); !resp.IsError() {
+			t.Error("code of complaint should fail")
+		}
+		if resp := suppressionRequest(logical.UpdateOperation, "bounces/alice@example.org", map[string]interface{}{"tag": "newsletter"}, t, b, storage); !resp.IsError() {
+			t.Error("tag of bounce should fail")
+		}
+	})
+
+	t.Run("invalid limit fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		if resp := suppressionRequest(logical.ListOperation, "unsubscribes", map[string]interface{}{"limit": 0}, t, b, storage); !resp.IsError() {
+			t.Error("limit 0 should fail")
+		}
+	})
+
+	t.Run("entries after the first page are listed with skip", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		for _, address := range []string{"alice@example.org", "bob@example.org", "carol@example.org"} {
+			testClient(b).complaints[address] = mailgun.Complaint{Address: address, Count: 1}
+		}
+
+		resp := suppressionRequest(logical.ListOperation, "complaints", map[string]interface{}{"limit": 2, "skip": 2}, t, b, storage)
+
+		if keys := resp.Data["keys"].([]string); len(keys) != 1 || keys[0] != "carol@example.org" {
+			t.Error("Unexpected keys:", keys)
+		}
+		if resp := suppressionRequest(logical.ListOperation, "complaints", map[string]interface{}{"skip": -1}, t, b, storage); !resp.IsError() {
+			t.Error("negative skip should fail")
+		}
+	})
+
+	t.Run("address with plus is escaped", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+		testClient(b).bounces["alice+news@example.org"] = mailgun.Bounce{Address: "alice+news@example.org"}
+
+		resp := suppressionRequest(logical.ReadOperation, "bounces/alice+news@example.org", nil, t, b, storage)
+
+		if resp == nil || resp.Data["address"] != "alice+news@example.org" {
+			t.Error("Unexpected bounce:", resp)
+		}
+		if escaped := escapeAddress("alice+news@example.org"); escaped != "alice%2Bnews@example.org" {
+			t.Error("Unexpected escaped address:", escaped)
+		}
+	})
+
+	t.Run("unconfigured mount fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+
+		if resp := suppressionRequest(logical.ListOperation, "bounces", nil, t, b, storage); !resp.IsError() {
+			t.Error("listing bounces of unconfigured mount should fail")
+		}
+	})
+}
+
+func suppressionRequest(operation logical.Operation, path string, data map[string]interface{}, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: operation,
+		Path:      "suppressions/" + path,
+		Data:      data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// unescapeAddress reverts escapeAddress like Mailgun does for URL paths.
+func unescapeAddress(address string) string {
+	unescaped, err := url.PathUnescape(address)
+	if err != nil {
+		panic(err)
+	}
+	return unescaped
+}
+
+// sortedAddresses returns the addresses of a suppression list in a stable
+// order for paging.
+func sortedAddresses(list interface{}) []string {
+	var addresses []string
+	for _, key := range reflect.ValueOf(list).MapKeys() {
+		addresses = append(addresses, key.String())
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func (c *testMailgunClient) GetBounces(limit, skip int) (int, []mailgun.Bounce, error) {
+	c.Lock()
+	defer c.Unlock()
+	var bounces []mailgun.Bounce
+	for i, address := range sortedAddresses(c.bounces) {
+		if i >= skip && len(bounces) < limit {
+			bounces = append(bounces, c.bounces[address])
+		}
+	}
+	return len(c.bounces), bounces, nil
+}
+
+func (c *testMailgunClient) GetSingleBounce(address string) (mailgun.Bounce, error) {
+	address = unescapeAddress(address)
+	c.Lock()
+	defer c.Unlock()
+	bounce, ok := c.bounces[address]
+	if !ok {
+		return mailgun.Bounce{}, errTestNotFound
+	}
+	return bounce, nil
+}
+
+func (c *testMailgunClient) AddBounce(address, code, message string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.bounces[address] = mailgun.Bounce{Address: address, Code: code, Error: message}
+	return nil
+}
+
+func (c *testMailgunClient) DeleteBounce(address string) error {
+	address = unescapeAddress(address)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.bounces[address]; !ok {
+		return errTestNotFound
+	}
+	delete(c.bounces, address)
+	return nil
+}
+
+func (c *testMailgunClient) GetUnsubscribes(limit, skip int) (int, []mailgun.Unsubscription, error) {
+	c.Lock()
+	defer c.Unlock()
+	var unsubscribes []mailgun.Unsubscription
+	for i, address := range sortedAddresses(c.unsubscribes) {
+		if i >= skip && len(unsubscribes) < limit {
+			unsubscribes = append(unsubscribes, c.unsubscribes[address])
+		}
+	}
+	return len(c.unsubscribes), unsubscribes, nil
+}
+
+func (c *testMailgunClient) GetUnsubscribesByAddress(address string) (int, []mailgun.Unsubscription, error) {
+	address = unescapeAddress(address)
+	c.Lock()
+	defer c.Unlock()
+	unsubscribe, ok := c.unsubscribes[address]
+	if !ok {
+		return 0, nil, errTestNotFound
+	}
+	return 1, []mailgun.Unsubscription{unsubscribe}, nil
+}
+
+func (c *testMailgunClient) Unsubscribe(address, tag string) error {
+	c.Lock()
+	defer c.Unlock()
+	unsubscribe := c.unsubscribes[address]
+	unsubscribe.Address = address
+	unsubscribe.Tags = append(unsubscribe.Tags, tag)
+	c.unsubscribes[address] = unsubscribe
+	return nil
+}
+
+func (c *testMailgunClient) RemoveUnsubscribe(address string) error {
+	address = unescapeAddress(address)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.unsubscribes[address]; !ok {
+		return errTestNotFound
+	}
+	delete(c.unsubscribes, address)
+	return nil
+}
+
+func (c *testMailgunClient) GetComplaints(limit, skip int) (int, []mailgun.Complaint, error) {
+	c.Lock()
+	defer c.Unlock()
+	var complaints []mailgun.Complaint
+	for i, address := range sortedAddresses(c.complaints) {
+		if i >= skip && len(complaints) < limit {
+			complaints = append(complaints, c.complaints[address])
+		}
+	}
+	return len(c.complaints), complaints, nil
+}
+
+func (c *testMailgunClient) GetSingleComplaint(address string) (mailgun.Complaint, error) {
+	address = unescapeAddress(address)
+	c.Lock()
+	defer c.Unlock()
+	complaint, ok := c.complaints[address]
+	if !ok {
+		return mailgun.Complaint{}, errTestNotFound
+	}
+	return complaint, nil
+}
+
+func (c *testMailgunClient) CreateComplaint(address string) error {
+	c.Lock()
+	defer c.Unlock()
+	complaint := c.complaints[address]
+	complaint.Address = address
+	complaint.Count++
+	c.complaints[address] = complaint
+	return nil
+}
+
+func (c *testMailgunClient) DeleteComplaint(address string) error {
+	address = unescapeAddress(address)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.complaints[address]; !ok {
+		return errTestNotFound
+	}
+	delete(c.complaints, address)
+	return nil
+}
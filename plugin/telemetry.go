@@ -0,0 +1,319 @@
+package mgsecret
+
+import (
+	"context"
+	"github.com/armon/go-metrics"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Credential operations reported in the metrics.
+const (
+	operationCreate = "create"
+	operationDelete = "delete"
+	operationRenew  = "renew"
+)
+
+// Error classes of failed credential operations.
+const (
+	errorClassUnauthorized     = "unauthorized"
+	errorClassNotFound         = "not_found"
+	errorClassRateLimited      = "rate_limited"
+	errorClassClientError      = "client_error"
+	errorClassServerError      = "server_error"
+	errorClassNetwork          = "network"
+	errorClassTimeout          = "timeout"
+	errorClassSmtpVerification = "smtp_verification"
+	errorClassStorage          = "storage"
+	errorClassCircuitOpen      = "circuit_open"
+	errorClassOther            = "other"
+)
+
+var (
+	metricsCredentialPrefix = []string{"mailgun", "credential"}
+	metricsActiveKey        = []string{"mailgun", "credentials", "active"}
+)
+
+// metricsEmitter is the part of *metrics.Metrics used by the backend.
+type metricsEmitter interface {
+	IncrCounterWithLabels(key []string, val float32, labels []metrics.Label)
+	MeasureSinceWithLabels(key []string, start time.Time, labels []metrics.Label)
+	SetGaugeWithLabels(key []string, val float32, labels []metrics.Label)
+}
+
+// telemetryServiceName prefixes the metric keys like the metrics of Vault.
+const telemetryServiceName = "vault"
+
+// telemetrySink emits the metrics to the statsd and statsite servers of the
+// config. The plugin runs in a process of its own, the telemetry of Vault
+// does not receive its metrics. They are dropped if no server is configured.
+type telemetrySink struct {
+	sync.RWMutex
+
+	statsdAddress   string
+	statsiteAddress string
+	metrics         *metrics.Metrics
+	sinks           []interface{ Shutdown() }
+}
+
+// configure emits the metrics to the servers of cfg, or drops them if cfg is
+// nil. The sinks are only replaced if the addresses changed.
+func (t *telemetrySink) configure(cfg *config) error {
+	var statsdAddress, statsiteAddress string
+	if cfg != nil {
+		statsdAddress, statsiteAddress = cfg.StatsdAddress, cfg.StatsiteAddress
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if statsdAddress == t.statsdAddress && statsiteAddress == t.statsiteAddress {
+		return nil
+	}
+	for _, sink := range t.sinks {
+		sink.Shutdown()
+	}
+	t.statsdAddress, t.statsiteAddress = "", ""
+	t.metrics, t.sinks = nil, nil
+
+	var fanout metrics.FanoutSink
+	if statsdAddress != "" {
+		sink, err := metrics.NewStatsdSink(statsdAddress)
+		if err != nil {
+			return err
+		}
+		fanout = append(fanout, sink)
+		t.sinks = append(t.sinks, sink)
+	}
+	if statsiteAddress != "" {
+		sink, err := metrics.NewStatsiteSink(statsiteAddress)
+		if err != nil {
+			return err
+		}
+		fanout = append(fanout, sink)
+		t.sinks = append(t.sinks, sink)
+	}
+	if len(fanout) > 0 {
+		conf := metrics.DefaultConfig(telemetryServiceName)
+		conf.EnableHostname = false
+		conf.EnableRuntimeMetrics = false
+		m, err := metrics.New(conf, fanout)
+		if err != nil {
+			return err
+		}
+		t.metrics = m
+	}
+	t.statsdAddress, t.statsiteAddress = statsdAddress, statsiteAddress
+	return nil
+}
+
+func (t *telemetrySink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.metrics != nil {
+		t.metrics.IncrCounterWithLabels(key, val, labels)
+	}
+}
+
+func (t *telemetrySink) MeasureSinceWithLabels(key []string, start time.Time, labels []metrics.Label) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.metrics != nil {
+		t.metrics.MeasureSinceWithLabels(key, start, labels)
+	}
+}
+
+func (t *telemetrySink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.metrics != nil {
+		t.metrics.SetGaugeWithLabels(key, val, labels)
+	}
+}
+
+// configureTelemetry points the metrics at the servers of cfg. Failures are
+// logged and do not fail the request.
+func (b *mailgunBackend) configureTelemetry(cfg *config) {
+	if err := b.telemetry.configure(cfg); err != nil {
+		b.Logger().Warn("failed to configure telemetry", "error", err)
+	}
+}
+
+// credentialOperation measures and logs a single create, delete or renew of a
+// credential.
+type credentialOperation struct {
+	metrics metricsEmitter
+	logger  log.Logger
+	name    string
+	labels  []metrics.Label
+	// logArgs identify the credential in the log without its secret.
+	logArgs []interface{}
+	start   time.Time
+}
+
+// startOperation starts an operation on the credential identified by
+// credential, the username or the list address.
+func (b *mailgunBackend) startOperation(name, credentialType, roleName, domain, credential string) *credentialOperation {
+	credentialKey := "username"
+	if credentialType == credentialTypeMailingList {
+		credentialKey = "list_address"
+	}
+	return &credentialOperation{
+		metrics: b.metrics,
+		logger:  b.Logger(),
+		name:    name,
+		labels: []metrics.Label{
+			{Name: "credential_type", Value: credentialType},
+			{Name: "role", Value: roleName},
+			{Name: "domain", Value: domain},
+		},
+		logArgs: []interface{}{
+			"credential_type", credentialType,
+			"role", roleName,
+			"domain", domain,
+			credentialKey, credential,
+		},
+		start: time.Now(),
+	}
+}
+
+// startLeaseOperation starts an operation on the credential of a lease.
+func (b *mailgunBackend) startLeaseOperation(name string, req *logical.Request, config *config, r *role) *credentialOperation {
+	roleName, _ := req.Secret.InternalData[internalDataRole].(string)
+	credential, ok := req.Secret.InternalData[internalDataUser].(string)
+	if !ok {
+		credential, _ = req.Secret.InternalData[internalDataList].(string)
+	}
+	op := b.startOperation(name, r.CredentialType, roleName, config.Domain, credential)
+	// Vault does not pass the lease ID to all plugin requests.
+	if req.Secret.LeaseID != "" {
+		op.logArgs = append(op.logArgs, "lease_id", req.Secret.LeaseID)
+	}
+	if req.ID != "" {
+		op.logArgs = append(op.logArgs, "request_id", req.ID)
+	}
+	return op
+}
+
+// succeeded emits the count and the latency of a successful operation.
+func (op *credentialOperation) succeeded() {
+	op.metrics.IncrCounterWithLabels(append(metricsCredentialPrefix, op.name), 1, op.labels)
+	op.metrics.MeasureSinceWithLabels(append(metricsCredentialPrefix, op.name, "time"), op.start, op.labels)
+
+	switch op.name {
+	case operationCreate:
+		op.logger.Info("created credential", op.logArgs...)
+	case operationDelete:
+		op.logger.Info("revoked credential", op.logArgs...)
+	default:
+		op.logger.Debug("renewed credential", op.logArgs...)
+	}
+}
+
+// failed emits the count and the latency of a failed operation with the
+// class of its error.
+func (op *credentialOperation) failed(errorClass string, err error) {
+	labels := append(op.labels[:len(op.labels):len(op.labels)], metrics.Label{Name: "error_class", Value: errorClass})
+	op.metrics.IncrCounterWithLabels(append(metricsCredentialPrefix, op.name, "error"), 1, labels)
+	op.metrics.MeasureSinceWithLabels(append(metricsCredentialPrefix, op.name, "time"), op.start, op.labels)
+
+	args := append(op.logArgs[:len(op.logArgs):len(op.logArgs)], "error_class", errorClass, "error", err.Error())
+	if op.name == operationDelete {
+		// The credential is left behind in Mailgun.
+		op.logger.Error("failed to revoke credential", args...)
+	} else {
+		op.logger.Warn("failed to "+op.name+" credential", args...)
+	}
+}
+
+// classifyError returns the error class of a failed Mailgun API request.
+func classifyError(err error) string {
+	if err == errCircuitOpen {
+		return errorClassCircuitOpen
+	}
+	if err == context.DeadlineExceeded {
+		return errorClassTimeout
+	}
+	if status := mailgun.GetStatusFromErr(err); status > 0 {
+		switch {
+		case status == 401 || status == 403:
+			return errorClassUnauthorized
+		case status == 404:
+			return errorClassNotFound
+		case status == 429:
+			return errorClassRateLimited
+		case status >= 500:
+			return errorClassServerError
+		case status >= 400:
+			return errorClassClientError
+		}
+		return errorClassOther
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return errorClassTimeout
+		}
+		return errorClassNetwork
+	}
+	return errorClassOther
+}
+
+// emitActiveCredentials sets the gauge of issued credentials that are not
+// revoked yet per role.
+func (b *mailgunBackend) emitActiveCredentials(ctx context.Context, s logical.Storage) error {
+	type gaugeKey struct{ credentialType, role string }
+	active := map[gaugeKey]int{}
+
+	roleNames, err := s.List(ctx, rolesStoragePrefix)
+	if err != nil {
+		return err
+	}
+	for _, roleName := range roleNames {
+		r, err := getRole(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			continue
+		}
+		// Roles without active credentials are reported with 0.
+		active[gaugeKey{r.CredentialType, roleName}] += 0
+		if r.CredentialType != credentialTypeLibrary {
+			continue
+		}
+		entries, err := listLibrary(ctx, s, roleName)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.CheckedOut {
+				active[gaugeKey{credentialTypeLibrary, roleName}]++
+			}
+		}
+	}
+
+	entries, err := listInventory(ctx, s)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.revoked() {
+			active[gaugeKey{entry.CredentialType, entry.Role}]++
+		}
+	}
+
+	for key, count := range active {
+		b.metrics.SetGaugeWithLabels(metricsActiveKey, float32(count), []metrics.Label{
+			{Name: "credential_type", Value: key.credentialType},
+			{Name: "role", Value: key.role},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package mgsecret
+
+import (
+	"context"
+	"errors"
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelemetry(t *testing.T) {
+	t.Run("created credentials are counted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		sink := testMetrics(b)
+		storeDefaultConfig(t, b, storage)
+
+		requestCredentials(t, b, storage)
+		requestCredentials(t, b, storage)
+
+		labels := map[string]string{"credential_type": credentialTypeSmtp, "domain": "example.com"}
+		if count := counterSum(sink, "mailgun.credential.create", labels); count != 2 {
+			t.Error("create counter should be 2 but is", count)
+		}
+		if count := sampleCount(sink, "mailgun.credential.create.time"); count != 2 {
+			t.Error("create latency should have 2 samples but has", count)
+		}
+	})
+
+	t.Run("failed deletes are counted with error class", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		sink := testMetrics(b)
+		storeDefaultConfig(t, b, storage)
+		resp := requestCredentials(t, b, storage)
+		username := resp.Secret.InternalData[internalDataUser].(string)
+		testClient(b).deleteErrors[username] = &mailgun.UnexpectedResponseError{Actual: 401}
+
+		revokeSecret(resp.Secret, t, b, storage)
+
+		labels := map[string]string{"error_class": errorClassUnauthorized}
+		if count := counterSum(sink, "mailgun.credential.delete.error", labels); count != 1 {
+			t.Error("delete error counter should be 1 but is", count)
+		}
+		if count := counterSum(sink, "mailgun.credential.delete", nil); count != 0 {
+			t.Error("failed delete should not be counted as delete but is", count)
+		}
+	})
+
+	t.Run("renewals of roles are counted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		sink := testMetrics(b)
+		storeDefaultConfig(t, b, storage)
+		storeRole("ci", map[string]interface{}{}, t, b, storage)
+		resp := requestRoleCredentials("ci", nil, t, b, storage)
+
+		renewSecret(resp.Secret, t, b, storage)
+
+		if count := counterSum(sink, "mailgun.credential.renew", map[string]string{"role": "ci"}); count != 1 {
+			t.Error("renew counter should be 1 but is", count)
+		}
+	})
+
+	t.Run("active credentials are reported per role", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		sink := testMetrics(b)
+		storeDefaultConfig(t, b, storage)
+		storeRole("ci", map[string]interface{}{}, t, b, storage)
+		requestRoleCredentials("ci", nil, t, b, storage)
+		requestRoleCredentials("ci", nil, t, b, storage)
+		storeRole("unused", map[string]interface{}{}, t, b, storage)
+
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err != nil {
+			t.Fatal(err)
+		}
+
+		if active := gaugeValue(sink, "mailgun.credentials.active", map[string]string{"role": "ci"}); active != 2 {
+			t.Error("active credentials of role ci should be 2 but are", active)
+		}
+		if active := gaugeValue(sink, "mailgun.credentials.active", map[string]string{"role": "unused"}); active != 0 {
+			t.Error("active credentials of role unused should be 0 but are", active)
+		}
+	})
+
+	t.Run("metrics are sent to the configured statsd server", func(t *testing.T) {
+		t.Parallel()
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		b, storage := testBackend(t)
+		defer b.telemetry.configure(nil)
+		storeDefaultConfig(t, b, storage)
+		storeConfig(map[string]interface{}{"statsd_address": server.LocalAddr().String()}, t, b, storage)
+
+		requestCredentials(t, b, storage)
+
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("No metrics received:", err)
+		}
+		if received := string(buf[:n]); !strings.Contains(received, "vault.mailgun.credential.create") {
+			t.Error("create counter was not received:", received)
+		}
+	})
+
+	t.Run("invalid statsd address is rejected", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		if resp := storeConfig(map[string]interface{}{"statsd_address": "localhost"}, t, b, storage); !resp.IsError() {
+			t.Error("address without port should be rejected")
+		}
+	})
+
+	t.Run("errors are classified", func(t *testing.T) {
+		t.Parallel()
+		tests := []struct {
+			err   error
+			class string
+		}{
+			{&mailgun.UnexpectedResponseError{Actual: 401}, errorClassUnauthorized},
+			{&mailgun.UnexpectedResponseError{Actual: 404}, errorClassNotFound},
+			{&mailgun.UnexpectedResponseError{Actual: 429}, errorClassRateLimited},
+			{&mailgun.UnexpectedResponseError{Actual: 400}, errorClassClientError},
+			{&mailgun.UnexpectedResponseError{Actual: 503}, errorClassServerError},
+			{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, errorClassNetwork},
+			{context.DeadlineExceeded, errorClassTimeout},
+			{errors.New("unknown"), errorClassOther},
+		}
+		for _, test := range tests {
+			if class := classifyError(test.err); class != test.class {
+				t.Errorf("class of %v should be %s but is %s", test.err, test.class, class)
+			}
+		}
+	})
+}
+
+// testMetrics makes the backend emit its metrics to an in-memory sink.
+func testMetrics(b *mailgunBackend) *metrics.InmemSink {
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	b.metrics, _ = metrics.New(conf, sink)
+	return sink
+}
+
+func counterSum(sink *metrics.InmemSink, name string, labels map[string]string) float64 {
+	sum := 0.0
+	for _, interval := range sink.Data() {
+		for _, counter := range interval.Counters {
+			if counter.Name == name && hasLabels(counter.Labels, labels) {
+				sum += counter.Sum
+			}
+		}
+	}
+	return sum
+}
+
+func sampleCount(sink *metrics.InmemSink, name string) int {
+	count := 0
+	for _, interval := range sink.Data() {
+		for _, sample := range interval.Samples {
+			if sample.Name == name {
+				count += sample.Count
+			}
+		}
+	}
+	return count
+}
+
+func gaugeValue(sink *metrics.InmemSink, name string, labels map[string]string) float32 {
+	for _, interval := range sink.Data() {
+		for _, gauge := range interval.Gauges {
+			if gauge.Name == name && hasLabels(gauge.Labels, labels) {
+				return gauge.Value
+			}
+		}
+	}
+	return -1
+}
+
+func hasLabels(actual []metrics.Label, expected map[string]string) bool {
+	found := 0
+	for _, label := range actual {
+		if value, ok := expected[label.Name]; ok {
+			if value != label.Value {
+				return false
+			}
+			found++
+		}
+	}
+	return found == len(expected)
+}
+
+func revokeSecret(secret *logical.Secret, t *testing.T, b *mailgunBackend, storage logical.Storage) *logical.Response {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.RevokeOperation,
+		Secret:    secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
@@ -0,0 +1,382 @@
+package mgsecret
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mailgun/mailgun-go"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookTimestampTolerance is how far the timestamp of a webhook request may
+// differ from the current time.
+const webhookTimestampTolerance = 5 * time.Minute
+
+// maxReportedEvents limits the webhook events kept per credential.
+const maxReportedEvents = 1000
+
+const webhookTokensStoragePrefix = "webhook-tokens/"
+
+var (
+	errInvalidWebhookSignature = errors.New("invalid webhook signature")
+	errReplayedToken           = errors.New("replayed webhook token")
+)
+
+func pathWebhook(b *mailgunBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "webhook",
+		Fields: map[string]*framework.FieldSchema{
+			"signature": {
+				Type:        framework.TypeMap,
+				Description: "Signature of the webhook request with the timestamp, token and signature.",
+			},
+			"event-data": {
+				Type:        framework.TypeMap,
+				Description: "The Mailgun event.",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathWebhookWrite,
+				Summary:  "Receive a Mailgun event webhook.",
+				Responses: map[int][]framework.Response{
+					http.StatusNoContent:           {{Description: "The event is recorded or ignored since it does not belong to a credential of this mount."}},
+					http.StatusBadRequest:          {{Description: "The webhook is not enabled or the event data is invalid."}},
+					http.StatusForbidden:           {{Description: "The request is unsigned, its signature is invalid, its timestamp is outdated or it was replayed."}},
+					http.StatusInternalServerError: {errorResponses[http.StatusInternalServerError]},
+				},
+			},
+		},
+		HelpSynopsis:    pathWebhookHelpSyn,
+		HelpDescription: pathWebhookHelpDesc,
+	}
+}
+
+func (b *mailgunBackend) pathWebhookWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.WebhookSigningKey == "" {
+		return logical.ErrorResponse("The webhook is not enabled. Configure 'webhook_signing_key' first."), nil
+	}
+
+	signature := data.Get("signature").(map[string]interface{})
+	token, expiry, err := verifyWebhookSignature(config.WebhookSigningKey, signature)
+	if err == nil {
+		err = b.acceptWebhookToken(ctx, req.Storage, token, expiry)
+	}
+	if err == errReplayedToken || err == errInvalidWebhookSignature {
+		b.Logger().Warn("rejected webhook request", "request_id", req.ID, "error", err)
+		return nil, logical.ErrPermissionDenied
+	}
+	if err != nil {
+		// Nothing was recorded, Mailgun may retry the request. Storing the
+		// token fails with logical.ErrReadOnly on a performance standby, it
+		// is returned unchanged so Vault forwards the request to the active
+		// node.
+		return nil, err
+	}
+
+	// Mailgun retries failed requests with the same token. The token is
+	// released if the event cannot be recorded, so the retry is not rejected
+	// as a replay.
+	resp, err := b.handleWebhookEvent(ctx, req, config, data)
+	if err != nil {
+		if deleteErr := req.Storage.Delete(ctx, webhookTokensStoragePrefix+token); deleteErr != nil {
+			b.Logger().Error("failed to release webhook token, the retry of the request will be rejected", "request_id", req.ID, "error", deleteErr)
+		}
+	}
+	return resp, err
+}
+
+// handleWebhookEvent records the event of a verified webhook request.
+func (b *mailgunBackend) handleWebhookEvent(ctx context.Context, req *logical.Request, config *config, data *framework.FieldData) (*logical.Response, error) {
+	event, sender, err := parseWebhookEvent(data.Get("event-data").(map[string]interface{}))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Unable to parse 'event-data': %v", err)), nil
+	}
+	// Events of messages not sent with a credential of this mount and events
+	// of unknown types are accepted as well, so Mailgun does not retry them.
+	if sender == "" {
+		return nil, nil
+	}
+	if _, err := event.eventType(); err != nil {
+		b.Logger().Debug("ignored webhook event", "request_id", req.ID, "error", err)
+		return nil, nil
+	}
+	entry, err := lookupInventoryEntry(ctx, req.Storage, sender)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.CredentialType != credentialTypeSmtp {
+		return nil, nil
+	}
+
+	// The monitor or a revocation may update the entry concurrently, it is
+	// read again under its lock.
+	lock := b.inventoryLock(entry.Username)
+	lock.Lock()
+	defer lock.Unlock()
+	entry, err = getInventoryEntry(ctx, req.Storage, entry.Username)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.revoked() {
+		return nil, nil
+	}
+
+	return nil, b.recordWebhookEvent(ctx, req.Storage, config, entry, event)
+}
+
+// verifyWebhookSignature returns the token of the signature and the time it
+// expires, or errInvalidWebhookSignature unless the signature was created with
+// the signing key and its timestamp is current.
+func verifyWebhookSignature(signingKey string, signature map[string]interface{}) (string, time.Time, error) {
+	form := url.Values{}
+	for _, key := range []string{"timestamp", "token", "signature"} {
+		value, ok := signature[key]
+		if !ok {
+			return "", time.Time{}, errInvalidWebhookSignature
+		}
+		form.Set(key, fmt.Sprint(value))
+	}
+
+	verified, err := mailgun.NewMailgun("", signingKey).VerifyWebhookRequest(&http.Request{Form: form})
+	if err != nil || !verified {
+		return "", time.Time{}, errInvalidWebhookSignature
+	}
+
+	seconds, err := strconv.ParseInt(form.Get("timestamp"), 10, 64)
+	if err != nil {
+		return "", time.Time{}, errInvalidWebhookSignature
+	}
+	timestamp := time.Unix(seconds, 0)
+	if age := time.Since(timestamp); age > webhookTimestampTolerance || age < -webhookTimestampTolerance {
+		return "", time.Time{}, errInvalidWebhookSignature
+	}
+
+	// The token is part of the storage key, it must not contain a path.
+	token := form.Get("token")
+	if token == "" || strings.Contains(token, "/") {
+		return "", time.Time{}, errInvalidWebhookSignature
+	}
+	return token, timestamp.Add(webhookTimestampTolerance), nil
+}
+
+// acceptWebhookToken records the token of a verified request until it
+// expires, or returns errReplayedToken if it was accepted before. The tokens
+// are stored, so replays are rejected across restarts and by every node of
+// the cluster.
+func (b *mailgunBackend) acceptWebhookToken(ctx context.Context, s logical.Storage, token string, expiry time.Time) error {
+	b.webhookLock.Lock()
+	defer b.webhookLock.Unlock()
+	accepted, err := getWebhookToken(ctx, s, token)
+	if err != nil {
+		return err
+	}
+	if accepted != nil && time.Now().Before(accepted.Expiry) {
+		return errReplayedToken
+	}
+	return putWebhookToken(ctx, s, token, &webhookToken{Expiry: expiry})
+}
+
+// webhookToken is the token of an accepted webhook request.
+type webhookToken struct {
+	Expiry time.Time
+}
+
+func getWebhookToken(ctx context.Context, s logical.Storage, token string) (*webhookToken, error) {
+	entryRaw, err := s.Get(ctx, webhookTokensStoragePrefix+token)
+	if err != nil || entryRaw == nil {
+		return nil, err
+	}
+	var accepted webhookToken
+	if err := entryRaw.DecodeJSON(&accepted); err != nil {
+		return nil, err
+	}
+	return &accepted, nil
+}
+
+func putWebhookToken(ctx context.Context, s logical.Storage, token string, accepted *webhookToken) error {
+	storageEntry, err := logical.StorageEntryJSON(webhookTokensStoragePrefix+token, accepted)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, storageEntry)
+}
+
+// pruneWebhookTokens deletes the stored tokens whose timestamps expired.
+func (b *mailgunBackend) pruneWebhookTokens(ctx context.Context, s logical.Storage) error {
+	tokens, err := s.List(ctx, webhookTokensStoragePrefix)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		accepted, err := getWebhookToken(ctx, s, token)
+		if err != nil {
+			return err
+		}
+		if accepted != nil && time.Now().Before(accepted.Expiry) {
+			continue
+		}
+		if err := s.Delete(ctx, webhookTokensStoragePrefix+token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseWebhookEvent returns the event and the sender of the message. Like
+// eventSentBy, the sender is the envelope sender and not the From header.
+// Events without envelope have no sender.
+func parseWebhookEvent(eventData map[string]interface{}) (reportedEvent, string, error) {
+	var parsed struct {
+		Event     string      `json:"event"`
+		Timestamp json.Number `json:"timestamp"`
+		Envelope  struct {
+			Sender string `json:"sender"`
+		} `json:"envelope"`
+	}
+	encoded, err := json.Marshal(eventData)
+	if err != nil {
+		return reportedEvent{}, "", err
+	}
+	if err := json.Unmarshal(encoded, &parsed); err != nil {
+		return reportedEvent{}, "", err
+	}
+	seconds, err := parsed.Timestamp.Float64()
+	if err != nil {
+		return reportedEvent{}, "", fmt.Errorf("invalid timestamp %q", parsed.Timestamp)
+	}
+	event := reportedEvent{
+		Event:     parsed.Event,
+		Timestamp: time.Unix(0, int64(seconds*float64(time.Second))),
+	}
+
+	return event, parsed.Envelope.Sender, nil
+}
+
+// recordWebhookEvent records the use of the credential and revokes it if the
+// abuse thresholds of its role are exceeded.
+func (b *mailgunBackend) recordWebhookEvent(ctx context.Context, s logical.Storage, config *config, entry *inventoryEntry, event reportedEvent) error {
+	eventType, err := event.eventType()
+	if err != nil {
+		return err
+	}
+	// Any event of a sent message shows the credential is used.
+	switch eventType {
+	case mailgun.EventAccepted, mailgun.EventDelivered, mailgun.EventFailed:
+		if event.Timestamp.After(entry.LastUsedAt) {
+			entry.LastUsedAt = event.Timestamp
+			entry.IdleAt = time.Time{}
+		}
+	}
+
+	r, err := getRole(ctx, s, entry.Role)
+	if err != nil {
+		return err
+	}
+	if r == nil || !r.AbuseMonitor {
+		return putInventoryEntry(ctx, s, entry)
+	}
+
+	since := time.Now().Add(-r.abuseWindow())
+	events := []reportedEvent{event}
+	for _, reported := range entry.ReportedEvents {
+		if reported.Timestamp.After(since) && len(events) < maxReportedEvents {
+			events = append(events, reported)
+		}
+	}
+	entry.ReportedEvents = events
+	if err := putInventoryEntry(ctx, s, entry); err != nil {
+		return err
+	}
+
+	reason := abuseReason(r, entry.reportedEvents(since))
+	if reason == "" {
+		return nil
+	}
+	resp, err := b.revokeIssuedCredential(ctx, s, config, entry, reason)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		b.Logger().Error("failed to revoke monitored credential", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "reason", reason, "error", resp.Error())
+		return nil
+	}
+	b.Logger().Warn("revoked monitored credential", "role", entry.Role, "domain", entry.Domain, "username", entry.Username, "reason", reason)
+	return nil
+}
+
+// reportedEvent is an event of a credential received by the webhook.
+type reportedEvent struct {
+	Event     string
+	Timestamp time.Time
+}
+
+// eventType returns the Mailgun type of the event, or an error if the type
+// is not known.
+func (event reportedEvent) eventType() (mailgun.EventType, error) {
+	var eventType mailgun.EventType
+	if err := eventType.UnmarshalText([]byte(event.Event)); err != nil {
+		return mailgun.EventUnknown, err
+	}
+	if eventType == mailgun.EventUnknown {
+		return mailgun.EventUnknown, fmt.Errorf("unknown event type %q", event.Event)
+	}
+	return eventType, nil
+}
+
+// reportedEvents returns the events received by the webhook after since.
+func (entry *inventoryEntry) reportedEvents(since time.Time) []mailgun.Event {
+	events := make([]mailgun.Event, 0, len(entry.ReportedEvents))
+	for _, reported := range entry.ReportedEvents {
+		if !reported.Timestamp.After(since) {
+			continue
+		}
+		eventType, err := reported.eventType()
+		if err != nil {
+			continue
+		}
+		event := mailgun.Event{Event: eventType, Timestamp: mailgun.TimestampNano(reported.Timestamp)}
+		// Mailgun does not post accepted messages, delivered ones count as
+		// sent instead.
+		if event.Event == mailgun.EventDelivered {
+			event.Event = mailgun.EventAccepted
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+const pathWebhookHelpSyn = `
+Receive Mailgun event webhooks.
+`
+
+const pathWebhookHelpDesc = `
+Mailgun posts events of the configured domain to "webhook". The endpoint does
+not require a Vault token, each request is verified with the
+"webhook_signing_key" of the config instead. Requests with a timestamp older
+than five minutes and replayed requests are rejected. The tokens of accepted
+requests are stored until their timestamp is outdated.
+
+The request must reach the active node. Performance standbys cannot store the
+token and Vault forwards the request. If the event cannot be recorded, the
+token is released again so the retry of Mailgun is accepted.
+
+Events of unknown types are accepted and ignored.
+
+Events of messages sent with an SMTP credential issued by this mount record
+the time the credential was last used and count towards the abuse thresholds
+of its role. The credentials are checked without polling the Mailgun events.
+Mailgun does not record the SMTP login, events are mapped to the credential
+by their envelope sender. Events without envelope sender are ignored.
+`
@@ -0,0 +1,344 @@
+package mgsecret
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mailgun/mailgun-go"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSigningKey = "webhook-signing-key"
+
+func TestPathWebhook(t *testing.T) {
+	t.Run("webhook is unauthenticated", func(t *testing.T) {
+		t.Parallel()
+		b, _ := testBackend(t)
+
+		if !strutil.StrListContains(b.SpecialPaths().Unauthenticated, "webhook") {
+			t.Error("webhook should be an unauthenticated path")
+		}
+	})
+
+	t.Run("delivered event records last use", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		username := strings.Split(requestCredentials(t, b, storage).Data["username"].(string), "@")[0]
+		sent := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+		_, err := postWebhook(signWebhook(time.Now(), "token"), webhookEventData("delivered", username+"@example.com", sent), b, storage)
+
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if lastUsed := readInventory(username, t, b, storage).Data["last_used_at"]; lastUsed != sent.Format(time.RFC3339) {
+			t.Error("last_used_at should be", sent.Format(time.RFC3339), "but is", lastUsed)
+		}
+	})
+
+	t.Run("events are mapped by envelope sender", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		sender := strings.Split(requestCredentials(t, b, storage).Data["username"].(string), "@")[0]
+		other := strings.Split(requestCredentials(t, b, storage).Data["username"].(string), "@")[0]
+		eventData := webhookEventData("delivered", sender+"@example.com", time.Now())
+		eventData["message"] = map[string]interface{}{
+			"headers": map[string]interface{}{"from": other + "@example.com"},
+		}
+
+		if _, err := postWebhook(signWebhook(time.Now(), "token"), eventData, b, storage); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+
+		if readInventory(sender, t, b, storage).Data["last_used_at"] == "" {
+			t.Error("use of the envelope sender should be recorded")
+		}
+		if lastUsed := readInventory(other, t, b, storage).Data["last_used_at"]; lastUsed != "" {
+			t.Error("use of the From address should not be recorded but is", lastUsed)
+		}
+	})
+
+	t.Run("token of unrecorded event is released", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		username := strings.Split(requestCredentials(t, b, storage).Data["username"].(string), "@")[0]
+		signature := signWebhook(time.Now(), "token")
+		eventData := webhookEventData("delivered", username+"@example.com", time.Now())
+
+		if _, err := postWebhook(signature, eventData, b, &failingStorage{Storage: storage, prefix: inventoryStoragePrefix}); err == nil {
+			t.Fatal("failing storage should fail the request")
+		}
+		_, err := postWebhook(signature, eventData, b, storage)
+
+		if err != nil {
+			t.Fatal("retry should be accepted but failed:", err)
+		}
+		if readInventory(username, t, b, storage).Data["last_used_at"] == "" {
+			t.Error("retried event should be recorded")
+		}
+	})
+
+	t.Run("read only storage is forwarded", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		readOnly := &failingStorage{Storage: storage, prefix: webhookTokensStoragePrefix, err: logical.ErrReadOnly}
+
+		_, err := postWebhook(signWebhook(time.Now(), "token"), webhookEventData("delivered", "vault.abcde@example.com", time.Now()), b, readOnly)
+
+		if err != logical.ErrReadOnly {
+			t.Error("expected logical.ErrReadOnly so Vault forwards the request, but got", err)
+		}
+	})
+
+	t.Run("invalid signature is rejected", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		signature := signWebhook(time.Now(), "token")
+		signature["signature"] = strings.Repeat("0", 64)
+
+		_, err := postWebhook(signature, webhookEventData("accepted", "vault.abcde@example.com", time.Now()), b, storage)
+
+		if err != logical.ErrPermissionDenied {
+			t.Error("invalid signature should be rejected but got", err)
+		}
+	})
+
+	t.Run("unsigned request is rejected", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+
+		_, err := postWebhook(nil, webhookEventData("accepted", "vault.abcde@example.com", time.Now()), b, storage)
+
+		if err != logical.ErrPermissionDenied {
+			t.Error("unsigned request should be rejected but got", err)
+		}
+	})
+
+	t.Run("replayed request is rejected", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		signature := signWebhook(time.Now(), "token")
+		eventData := webhookEventData("accepted", "vault.abcde@example.com", time.Now())
+
+		if _, err := postWebhook(signature, eventData, b, storage); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		_, err := postWebhook(signature, eventData, b, storage)
+
+		if err != logical.ErrPermissionDenied {
+			t.Error("replayed request should be rejected but got", err)
+		}
+	})
+
+	t.Run("replayed request is rejected after a restart", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		signature := signWebhook(time.Now(), "token")
+		eventData := webhookEventData("accepted", "vault.abcde@example.com", time.Now())
+		if _, err := postWebhook(signature, eventData, b, storage); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		restarted, _ := testBackend(t)
+
+		_, err := postWebhook(signature, eventData, restarted, storage)
+
+		if err != logical.ErrPermissionDenied {
+			t.Error("replayed request should be rejected but got", err)
+		}
+	})
+
+	t.Run("expired tokens are pruned", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		if err := putWebhookToken(context.Background(), storage, "expired", &webhookToken{Expiry: time.Now().Add(-time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+
+		monitor(t, b, storage)
+
+		if tokens, _ := storage.List(context.Background(), webhookTokensStoragePrefix); len(tokens) != 0 {
+			t.Error("expired tokens should be pruned:", tokens)
+		}
+	})
+
+	t.Run("outdated request is rejected", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+
+		_, err := postWebhook(signWebhook(time.Now().Add(-time.Hour), "token"), webhookEventData("accepted", "vault.abcde@example.com", time.Now()), b, storage)
+
+		if err != logical.ErrPermissionDenied {
+			t.Error("outdated request should be rejected but got", err)
+		}
+	})
+
+	t.Run("disabled webhook fails", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testBackend(t)
+		storeDefaultConfig(t, b, storage)
+
+		resp, err := postWebhook(signWebhook(time.Now(), "token"), webhookEventData("accepted", "vault.abcde@example.com", time.Now()), b, storage)
+
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if !resp.IsError() {
+			t.Error("request to disabled webhook should fail")
+		}
+	})
+
+	t.Run("events of unknown senders are accepted", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+
+		resp, err := postWebhook(signWebhook(time.Now(), "token"), webhookEventData("accepted", "postmaster@example.com", time.Now()), b, storage)
+
+		if err != nil || resp != nil {
+			t.Error("Unexpected response:", resp, err)
+		}
+	})
+
+	t.Run("events of unknown types are ignored", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		username := strings.Split(requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string), "@")[0]
+
+		resp, err := postWebhook(signWebhook(time.Now(), "token"), webhookEventData("teleported", username+"@example.com", time.Now()), b, storage)
+
+		if err != nil || resp != nil {
+			t.Error("Unexpected response:", resp, err)
+		}
+		if entry, _ := getInventoryEntry(context.Background(), storage, username); len(entry.ReportedEvents) != 0 {
+			t.Error("unknown event should not be recorded:", entry.ReportedEvents)
+		}
+	})
+
+	t.Run("concurrent events are all recorded", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		username := strings.Split(requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string), "@")[0]
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				postWebhook(signWebhook(time.Now(), fmt.Sprint("token", i)), webhookEventData("delivered", username+"@example.com", time.Now()), b, storage)
+			}(i)
+		}
+		wg.Wait()
+
+		if entry, _ := getInventoryEntry(context.Background(), storage, username); len(entry.ReportedEvents) != 20 {
+			t.Error("Expected 20 recorded events, but was", len(entry.ReportedEvents))
+		}
+	})
+
+	t.Run("credential exceeding abuse threshold is revoked", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		username := strings.Split(requestRoleCredentials("monitored", nil, t, b, storage).Data["username"].(string), "@")[0]
+
+		for i := 0; i < 2; i++ {
+			eventData := webhookEventData("failed", username+"@example.com", time.Now())
+			if _, err := postWebhook(signWebhook(time.Now(), fmt.Sprint("token", i)), eventData, b, storage); err != nil {
+				t.Fatal("Unexpected error:", err)
+			}
+		}
+
+		if _, ok := testClient(b).credentials[username]; ok {
+			t.Error("credential should be deleted in mailgun")
+		}
+		if reason := readInventory(username, t, b, storage).Data["revoked_reason"].(string); !strings.Contains(reason, "abuse_max_bounces") {
+			t.Error("Unexpected revoked_reason:", reason)
+		}
+		if requests := testClient(b).eventRequests; requests != 0 {
+			t.Error("events should not be polled but were requested", requests, "times")
+		}
+	})
+
+	t.Run("idle credentials are polled before they are revoked", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		username := requestIdleCredential(t, b, storage)
+
+		monitor(t, b, storage)
+
+		if resp := readInventory(username, t, b, storage); resp.Data["revoked_at"] == "" {
+			t.Error("credential should be marked as revoked")
+		}
+		if requests := testClient(b).eventRequests; requests != 1 {
+			t.Error("events should be polled once but were requested", requests, "times")
+		}
+	})
+
+	t.Run("idle credentials used without reported events are kept", func(t *testing.T) {
+		t.Parallel()
+		b, storage := testWebhookBackend(t)
+		username := requestIdleCredential(t, b, storage)
+		testClient(b).events[username+"@example.com"] = recentEvents(mailgun.EventAccepted)
+
+		monitor(t, b, storage)
+
+		resp := readInventory(username, t, b, storage)
+		if resp.Data["revoked_at"] != "" {
+			t.Error("credential should not be marked as revoked")
+		}
+		if resp.Data["last_used_at"] == "" {
+			t.Error("last_used_at should be recorded")
+		}
+	})
+}
+
+func testWebhookBackend(t *testing.T) (*mailgunBackend, logical.Storage) {
+	b, storage := testMonitorBackend(t)
+	storeConfig(map[string]interface{}{"webhook_signing_key": testSigningKey}, t, b, storage)
+	return b, storage
+}
+
+func signWebhook(timestamp time.Time, token string) map[string]interface{} {
+	seconds := fmt.Sprint(timestamp.Unix())
+	h := hmac.New(sha256.New, []byte(testSigningKey))
+	h.Write([]byte(seconds + token))
+	return map[string]interface{}{
+		"timestamp": seconds,
+		"token":     token,
+		"signature": hex.EncodeToString(h.Sum(nil)),
+	}
+}
+
+func webhookEventData(event, sender string, timestamp time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"event":     event,
+		"timestamp": float64(timestamp.UnixNano()) / float64(time.Second),
+		"envelope": map[string]interface{}{
+			"sender": sender,
+		},
+		"message": map[string]interface{}{
+			"headers": map[string]interface{}{
+				"from": "Vault <" + sender + ">",
+			},
+		},
+	}
+}
+
+func postWebhook(signature, eventData map[string]interface{}, b *mailgunBackend, storage logical.Storage) (*logical.Response, error) {
+	data := map[string]interface{}{
+		"event-data": eventData,
+	}
+	if signature != nil {
+		data["signature"] = signature
+	}
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "webhook",
+		Data:      data,
+	})
+}